@@ -0,0 +1,33 @@
+package catgirl
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+//go:embed main.yml upgrade.yml files roles mastodon pleroma gotosocial
+var Playbook embed.FS
+
+// Materialize writes the playbook out into dir, where Ansible can get at it.
+func Materialize(dir string) error {
+	return fs.WalkDir(Playbook, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(path))
+
+		if d.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+
+		data, err := Playbook.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(target, data, 0600)
+	})
+}
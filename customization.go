@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/CuteAP/fediverse.express/templates"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Customization is how the user wants their instance set up, applied once it
+// is running.
+type Customization struct {
+	Name            string `json:"name,omitempty"`
+	Description     string `json:"description,omitempty"`
+	MaintainerName  string `json:"maintainerName,omitempty"`
+	MaintainerEmail string `json:"maintainerEmail,omitempty"`
+	// ClosedRegistrations keeps strangers from signing up.
+	ClosedRegistrations bool `json:"closedRegistrations,omitempty"`
+	// Theme is one of misskeyThemes, or empty for Misskey's own default.
+	Theme string `json:"theme,omitempty"`
+}
+
+// misskeyThemes are the themes Misskey comes with, by the name of their file.
+var misskeyThemes = []struct {
+	ID   string
+	Name string
+}{
+	{"l-light", "Light"},
+	{"l-coffee", "Coffee"},
+	{"l-apricot", "Apricot"},
+	{"l-rainy", "Rainy"},
+	{"l-vivid", "Vivid"},
+	{"l-sushi", "Sushi"},
+	{"d-dark", "Dark"},
+	{"d-persimmon", "Persimmon"},
+	{"d-astro", "Astro"},
+	{"d-future", "Future"},
+	{"d-botanical", "Botanical"},
+	{"d-cherry", "Cherry"},
+	{"d-ice", "Ice"},
+	{"d-u0", "Mars"},
+}
+
+// readCustomization reads the customization part of the install form. It
+// returns nil if the user left everything as it was.
+func readCustomization(ctx *fiber.Ctx) (*Customization, error) {
+	c := &Customization{
+		Name:                strings.TrimSpace(ctx.FormValue("InstanceName")),
+		Description:         strings.TrimSpace(ctx.FormValue("InstanceDescription")),
+		MaintainerName:      strings.TrimSpace(ctx.FormValue("MaintainerName")),
+		MaintainerEmail:     strings.TrimSpace(ctx.FormValue("MaintainerEmail")),
+		ClosedRegistrations: ctx.FormValue("Registrations") == "closed",
+		Theme:               ctx.FormValue("Theme"),
+	}
+
+	if *c == (Customization{}) {
+		return nil, nil
+	}
+
+	if utf8.RuneCountInString(c.Name) > 64 {
+		return nil, errors.New("keep your instance's name to 64 characters or fewer")
+	}
+	if utf8.RuneCountInString(c.Description) > 2000 {
+		return nil, errors.New("keep your instance's description to 2000 characters or fewer")
+	}
+	if utf8.RuneCountInString(c.MaintainerName) > 64 {
+		return nil, errors.New("keep the maintainer's name to 64 characters or fewer")
+	}
+	if c.MaintainerEmail != "" {
+		if err := validateEmail(c.MaintainerEmail); err != nil {
+			return nil, fmt.Errorf("maintainer's e-mail address: %v", err)
+		}
+	}
+	if c.Theme != "" && !knownTheme(c.Theme) {
+		return nil, errors.New("choose one of the themes offered")
+	}
+
+	return c, nil
+}
+
+func knownTheme(id string) bool {
+	for _, theme := range misskeyThemes {
+		if theme.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Vars passes the customization on to the playbook. Ansible evaluates
+// templates in whatever it is handed, so the text the user typed goes over
+// base64-encoded and the playbook decodes it where it's used.
+func (c *Customization) Vars() map[string]interface{} {
+	encode := base64.StdEncoding.EncodeToString
+
+	return map[string]interface{}{
+		"name":                 encode([]byte(c.Name)),
+		"description":          encode([]byte(c.Description)),
+		"maintainer_name":      encode([]byte(c.MaintainerName)),
+		"maintainer_email":     encode([]byte(c.MaintainerEmail)),
+		"disable_registration": c.ClosedRegistrations,
+		"theme":                c.Theme,
+	}
+}
+
+// customizationFields renders the customization part of the install form,
+// filled in with what was asked for last time, if anything.
+func customizationFields(c *Customization) string {
+	if c == nil {
+		c = &Customization{}
+	}
+
+	open, closed := "selected", ""
+	if c.ClosedRegistrations {
+		open, closed = "", "selected"
+	}
+
+	themes := "<option value=\"\">Misskey's default</option>"
+	for _, theme := range misskeyThemes {
+		selected := ""
+		if theme.ID == c.Theme {
+			selected = " selected"
+		}
+
+		themes += fmt.Sprintf("<option value=\"%s\"%s>%s</option>", theme.ID, selected, html.EscapeString(theme.Name))
+	}
+
+	return fmt.Sprintf(templates.InstallCustomize,
+		html.EscapeString(c.Name),
+		html.EscapeString(c.Description),
+		html.EscapeString(c.MaintainerName),
+		html.EscapeString(c.MaintainerEmail),
+		open, closed,
+		themes)
+}
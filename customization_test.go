@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestCustomizationVarsAreNotTemplates(t *testing.T) {
+	c := &Customization{
+		Name:            "{{ lookup('pipe', 'id') }}",
+		Description:     "{% for x in range(9) %}{# hi #}{% endfor %}",
+		MaintainerName:  "Ms. {{",
+		MaintainerEmail: "admin@example.com",
+	}
+
+	vars := c.Vars()
+	for name, want := range map[string]string{
+		"name":             c.Name,
+		"description":      c.Description,
+		"maintainer_name":  c.MaintainerName,
+		"maintainer_email": c.MaintainerEmail,
+	} {
+		value := vars[name].(string)
+		if strings.ContainsAny(value, "{}%#") {
+			t.Errorf("%s goes to the playbook as %q, which Ansible could evaluate", name, value)
+		}
+
+		// the playbook b64decodes it back
+		got, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || string(got) != want {
+			t.Errorf("%s arrives as %q (%v), want %q", name, got, err, want)
+		}
+	}
+}
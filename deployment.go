@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// dataDir is where deployments and their logs are kept; see CATGIRL_DATA_DIR.
+	dataDir = "data"
+
+	storeLock sync.Mutex
+)
+
+// Deployment is what we remember about an instance we've set up.
+type Deployment struct {
+	IPv4     string `json:"ipv4"`
+	IPv6     string `json:"ipv6,omitempty"`
+	Hostname string `json:"hostname"`
+	Provider string `json:"provider"`
+	// Email is where Let's Encrypt sends notices about the instance's certificate.
+	Email string `json:"email,omitempty"`
+	// Staging deployments get a test certificate from Let's Encrypt's staging
+	// environment, which isn't rate limited but isn't trusted by browsers either.
+	Staging bool `json:"staging,omitempty"`
+	// Certificate is the kind of certificate the server last got, "staging" or
+	// "production", or empty if it has none yet.
+	Certificate string `json:"certificate,omitempty"`
+	// Software is what the instance runs, see software; empty means Misskey.
+	Software string `json:"software,omitempty"`
+	// Version is the Misskey version the server last had installed.
+	Version string `json:"version,omitempty"`
+	// Commit is the commit that version resolved to when it was checked out.
+	Commit string `json:"commit,omitempty"`
+	// IDGeneration is the scheme Misskey makes up IDs with. It is settled on
+	// the first install and can't change once anything has been posted.
+	IDGeneration string `json:"idGeneration,omitempty"`
+	// Proxy is the HTTP proxy Misskey makes its outgoing requests through, if
+	// it needs one.
+	Proxy string `json:"proxy,omitempty"`
+	// DirectRemoteFiles has Misskey link straight to remote media, rather than
+	// serving it through the instance.
+	DirectRemoteFiles bool `json:"directRemoteFiles,omitempty"`
+	// Customization is how the user asked for the instance to be set up, if
+	// they asked for anything.
+	Customization *Customization `json:"customization,omitempty"`
+	// HostKey is the server's SSH host key as first seen, in authorized_keys format.
+	HostKey string       `json:"hostKey,omitempty"`
+	Jobs    []*JobRecord `json:"jobs"`
+}
+
+// JobRecord is a single install run against a deployment.
+type JobRecord struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Cancelled bool      `json:"cancelled,omitempty"`
+	// Interrupted jobs were stopped by fediverse.express shutting down.
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	// Version is the Misskey version the job installs, if it installs one.
+	Version string `json:"version,omitempty"`
+
+	// From is the role the job started at, if it didn't run the whole playbook.
+	From           string   `json:"from,omitempty"`
+	CompletedRoles []string `json:"completedRoles,omitempty"`
+	FailedRole     string   `json:"failedRole,omitempty"`
+
+	// Credentials are the secrets the run generated on the server, by name.
+	Credentials map[string]string `json:"credentials,omitempty"`
+}
+
+func deploymentDir(ipv4 string) (string, error) {
+	if net.ParseIP(ipv4) == nil {
+		return "", errors.New("deployment address is not an IP address")
+	}
+
+	return filepath.Join(dataDir, "deployments", ipv4), nil
+}
+
+// loadDeployment reads the deployment for a server. If there is none yet, the
+// error satisfies os.IsNotExist.
+func loadDeployment(ipv4 string) (*Deployment, error) {
+	dir, err := deploymentDir(ipv4)
+	if err != nil {
+		return nil, err
+	}
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(dir, "deployment.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Deployment{}
+	return d, json.Unmarshal(data, d)
+}
+
+// saveDeployment writes a deployment to the store, replacing what was there.
+func saveDeployment(d *Deployment) error {
+	dir, err := deploymentDir(d.IPv4)
+	if err != nil {
+		return err
+	}
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	// logs and credentials end up in here, so nobody else gets to look
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, "deployment.json.tmp")
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, "deployment.json"))
+}
+
+// archiveDeployment moves the deployment for a server, logs and all, out of
+// the way, so that a new server that got the same address starts afresh.
+// There being none is fine.
+func archiveDeployment(ipv4 string) error {
+	dir, err := deploymentDir(ipv4)
+	if err != nil {
+		return err
+	}
+
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	_, err = os.Stat(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	archive := filepath.Join(dataDir, "archive")
+	err = os.MkdirAll(archive, 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(dir, filepath.Join(archive, ipv4+"-"+time.Now().UTC().Format("20060102-150405")))
+}
+
+// NewJob records the start of a new job against the deployment.
+func (d *Deployment) NewJob(kind string) *JobRecord {
+	job := &JobRecord{
+		ID:      time.Now().UTC().Format("20060102-150405") + "-" + RandomString(4),
+		Kind:    kind,
+		Started: time.Now(),
+	}
+
+	d.Jobs = append(d.Jobs, job)
+	return job
+}
+
+// LastJob returns the most recently started job, if there has been one.
+func (d *Deployment) LastJob() *JobRecord {
+	if len(d.Jobs) == 0 {
+		return nil
+	}
+
+	return d.Jobs[len(d.Jobs)-1]
+}
+
+// ResumeRole returns the role a failed install can be resumed at, or an empty
+// string if it has to start from the beginning. Cancelled installs may have
+// been stopped anywhere, so those always start over.
+func (d *Deployment) ResumeRole() string {
+	job := d.LastJob()
+	if job == nil || job.Error == "" || job.Cancelled || !softwareOf(d).IsRole(job.FailedRole) {
+		return ""
+	}
+
+	return job.FailedRole
+}
+
+// Installed tells whether the deployment's software has been installed on the server.
+func (d *Deployment) Installed() bool {
+	for _, job := range d.Jobs {
+		for _, role := range job.CompletedRoles {
+			if role == "install" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Secret returns the most recent value a job generated for the named secret,
+// or an empty string if there is none.
+func (d *Deployment) Secret(name string) string {
+	for i := len(d.Jobs) - 1; i >= 0; i-- {
+		if value := d.Jobs[i].Credentials[name]; value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// Generated tells whether any job generated the named secret, even if it has
+// since been taken off the record.
+func (d *Deployment) Generated(name string) bool {
+	for _, job := range d.Jobs {
+		if _, ok := job.Credentials[name]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TakeCredentials takes the named secrets off the record and returns the most
+// recent value of each. They are kept as empty strings, so it can still be
+// told that they were generated.
+func (d *Deployment) TakeCredentials(names map[string]bool) map[string]string {
+	taken := map[string]string{}
+
+	for i := len(d.Jobs) - 1; i >= 0; i-- {
+		for name, value := range d.Jobs[i].Credentials {
+			if !names[name] || value == "" {
+				continue
+			}
+
+			if _, ok := taken[name]; !ok {
+				taken[name] = value
+			}
+			d.Jobs[i].Credentials[name] = ""
+		}
+	}
+
+	return taken
+}
+
+// LogPath is where the transcript of a job is kept.
+func (d *Deployment) LogPath(job *JobRecord) string {
+	dir, err := deploymentDir(d.IPv4)
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, job.ID+".log")
+}
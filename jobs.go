@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/CuteAP/fediverse.express/runner"
+)
+
+// jobSpec describes a playbook run to start against a deployment.
+type jobSpec struct {
+	Kind string
+	// Playbook is the playbook to run; the software's install playbook if empty.
+	Playbook string
+	// From is the role a resumed install picks up at.
+	From string
+	// Roles limits the run to these roles. Nil runs the whole install playbook.
+	Roles []string
+	// Version is the version of the software to install, if the job installs one.
+	Version string
+	// Vars are passed to the playbook on top of the deployment's own settings.
+	Vars map[string]interface{}
+}
+
+// commitOutput is the file in the secrets folder the playbooks write the
+// commit they checked out to.
+const commitOutput = "misskey_commit"
+
+// jobStatus returns the status of the last job started on a server, if it is
+// still being followed.
+func jobStatus(ipv4 string) (*Status, bool) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	sx, ok := status[ipv4]
+	return sx, ok
+}
+
+// forgetStatus stops following sx, unless another job has been started on the
+// server since.
+func forgetStatus(ipv4 string, sx *Status) {
+	statusLock.Lock()
+	defer statusLock.Unlock()
+
+	if status[ipv4] == sx {
+		delete(status, ipv4)
+	}
+}
+
+// startJob records a new job against a deployment and queues it up to run
+// with key. The returned status follows it along.
+func startJob(deployment *Deployment, key []byte, spec jobSpec) (*Status, error) {
+	ipv4 := deployment.IPv4
+	sw := softwareOf(deployment)
+
+	roles := spec.Roles
+	if roles == nil {
+		roles = sw.Roles
+	}
+
+	certificate := "production"
+	if deployment.Staging {
+		certificate = "staging"
+	}
+
+	vars := map[string]interface{}{
+		"domain":  deployment.Hostname,
+		"email":   deployment.Email,
+		"staging": deployment.Staging,
+		// certbot holds on to the certificate it has until it's due, even if
+		// it's the wrong kind
+		"certbot_force": deployment.Certificate != "" && deployment.Certificate != certificate,
+		"min_ram_mb":    sw.MinimumRAM,
+	}
+	if sw.DeploymentVars != nil {
+		for k, v := range sw.DeploymentVars(deployment) {
+			vars[k] = v
+		}
+	}
+	if spec.Version != "" && sw.VersionVar != "" {
+		vars[sw.VersionVar] = spec.Version
+	}
+	for k, v := range spec.Vars {
+		vars[k] = v
+	}
+
+	for _, name := range sw.Vars {
+		if v, ok := vars[name]; !ok || v == "" {
+			return nil, fmt.Errorf("%s needs %s set", sw.Name, name)
+		}
+	}
+
+	// the server is configured with these already, so they carry over
+	kept := map[string]string{}
+	for name := range sw.Outputs {
+		if secret := deployment.Secret(name); secret != "" && !showOnce[name] {
+			kept[name] = secret
+		}
+	}
+
+	job := deployment.NewJob(spec.Kind)
+	job.From = spec.From
+	job.Version = spec.Version
+
+	err := saveDeployment(deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.OpenFile(deployment.LogPath(job), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	jobCtx, cancel := context.WithCancel(context.Background())
+
+	sx := &Status{
+		Kind:     spec.Kind,
+		Progress: &Progress{roles: roles},
+		cancel:   cancel,
+	}
+	statusLock.Lock()
+	status[ipv4] = sx
+	statusLock.Unlock()
+
+	installs.Enqueue(sx, func() {
+		defer cancel()
+
+		// the key and everything the run generates stay in here, and
+		// only for as long as the job runs
+		workDir, err := newWorkDir(key, kept)
+		if err != nil {
+			log.Printf("Error creating work directory: %v", err)
+		} else {
+			defer func() {
+				err := os.RemoveAll(workDir)
+				if err != nil {
+					log.Printf("Error removing work directory %s: %v", workDir, err)
+				}
+			}()
+		}
+
+		cancelled := false
+		err = func() error {
+			if workDir == "" {
+				return errors.New("An internal server error occured. Please try again.")
+			}
+
+			playbookFile := spec.Playbook
+			if playbookFile == "" {
+				playbookFile = sw.Playbook
+			}
+
+			dir := playbookDir
+			if dir == "" {
+				dir = filepath.Join(workDir, "playbook")
+			}
+
+			// having nice things is STILL not allowed
+			user := "root"
+			if deployment.Provider == "aws" {
+				user = "ubuntu"
+			}
+
+			secretFiles := []string{}
+			for _, name := range sortedKeys(sw.Outputs) {
+				secretFiles = append(secretFiles, filepath.Join(workDir, "secrets", name))
+			}
+
+			playbook := &runner.Job{
+				Dir:        dir,
+				Playbook:   playbookFile,
+				Host:       ipv4,
+				User:       user,
+				PrivateKey: filepath.Join(workDir, "id"),
+				WorkDir:    workDir,
+				HostKey:    deployment.HostKey,
+				Vars:       vars,
+				Tags:       spec.Roles,
+				Writer: &progressWriter{
+					progress: sx.Progress,
+					out: &redactingWriter{
+						out:         io.MultiWriter(os.Stdout, logFile),
+						secretFiles: secretFiles,
+					},
+				},
+			}
+
+			// a new server may still be booting; its host key gets pinned once it's
+			// done, and only that key is trusted after
+			var err error
+			if jobCtx.Err() == nil {
+				sx.Progress.SetTask("Waiting for your server to be ready")
+
+				err = waitForSSH(jobCtx, playbook, sshTimeout)
+				if playbook.HostKey != deployment.HostKey {
+					log.Printf("Pinned host key for %s: %s", ipv4, playbook.HostKey)
+					deployment.HostKey = playbook.HostKey
+				}
+
+				var notReady *runner.NotReadyError
+				if errors.As(err, &notReady) {
+					log.Printf("Server %s wasn't ready: %v", ipv4, err)
+
+					return notReadyMessage(notReady, sshTimeout)
+				}
+			}
+
+			// it may have been cancelled while it was waiting in the queue
+			if jobCtx.Err() == nil {
+				err = installer.Run(jobCtx, playbook)
+			}
+
+			if jobCtx.Err() != nil && sx.Interrupted() {
+				log.Printf("Install on %s was interrupted by shutdown", ipv4)
+
+				if spec.Kind == "upgrade" {
+					// running upgrades are left to finish, so it never got to start
+					return errors.New("fediverse.express restarted before your upgrade got its turn. Your instance wasn't touched; please start the upgrade again.")
+				}
+
+				return errors.New("fediverse.express restarted while your installation was running. Please try again; it will pick up where it left off.")
+			}
+
+			if jobCtx.Err() != nil {
+				log.Printf("Install on %s was cancelled", ipv4)
+
+				cancelled = true
+				return errors.New("You cancelled the installation. Your server may be partly set up, so the next attempt will start over from the beginning.")
+			}
+
+			if err != nil {
+				log.Printf("Playbook exited with error: %v", err)
+
+				if failure := sx.Progress.Failure(); failure != nil {
+					log.Printf("Task %q (role %s, module %s) failed on %s: %s", failure.Task, failure.Role, failure.Module, failure.Host, failure.Message)
+
+					return fmt.Errorf("%s. Check that your server is on and working and try again. If this error persists, please e-mail us so we can help you out.", html.EscapeString(failure.Error()))
+				}
+
+				return fmt.Errorf("There was an error preparing your instance. Check that your server is on and working and try again. If this error persists, please e-mail us so we can help you out.")
+			}
+
+			return nil
+		}()
+
+		logFile.Close()
+
+		job.Finished = time.Now()
+		job.CompletedRoles = sx.Progress.CompletedRoles()
+		job.Cancelled = cancelled
+		job.Interrupted = sx.Interrupted()
+		if err != nil {
+			job.Error = err.Error()
+
+			job.FailedRole = sx.Progress.FailedRole()
+			if job.FailedRole == "" {
+				// it didn't get as far as the role it started at
+				job.FailedRole = spec.From
+			}
+		} else {
+			job.CompletedRoles = roles
+		}
+
+		// hand over what the run generated before the work directory goes
+		commit := ""
+		if workDir != "" {
+			credentials, err := readSecrets(filepath.Join(workDir, "secrets"))
+			if err != nil {
+				log.Printf("Error reading generated secrets for %s: %v", ipv4, err)
+			}
+
+			// the playbook leaves the commit it checked out with the secrets,
+			// though it's no secret
+			commit = credentials[commitOutput]
+			delete(credentials, commitOutput)
+
+			if len(credentials) > 0 {
+				job.Credentials = credentials
+			}
+		}
+
+		for _, role := range job.CompletedRoles {
+			switch {
+			case role == "nginx":
+				deployment.Certificate = certificate
+			case (role == "install" || role == "upgrade") && spec.Version != "":
+				deployment.Version = spec.Version
+				deployment.Commit = commit
+			}
+		}
+
+		if err := saveDeployment(deployment); err != nil {
+			log.Printf("Error saving deployment %s: %v", ipv4, err)
+		}
+
+		// only now that the deployment is saved may anyone see the job is
+		// over, as the done page reads what it generated from there
+		if cancelled {
+			sx.cancelWith(err)
+		} else {
+			sx.finish(err)
+		}
+	})
+
+	return sx, nil
+}
@@ -1,25 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
+	"crypto/subtle"
 	_ "embed"
-	"encoding/pem"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/CuteAP/fediverse.express/runner"
+	"github.com/CuteAP/fediverse.express/runner/ansible"
+	"github.com/CuteAP/fediverse.express/runner/fake"
+	"github.com/CuteAP/fediverse.express/runner/native"
 	"github.com/CuteAP/fediverse.express/server"
 	"github.com/CuteAP/fediverse.express/server/aws"
 	"github.com/CuteAP/fediverse.express/server/digitalocean"
 	"github.com/CuteAP/fediverse.express/templates"
-	ansibler "github.com/apenella/go-ansible"
 	"github.com/asaskevich/govalidator"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
@@ -35,7 +44,31 @@ var (
 		"aws":          &aws.AWS{},
 	}
 
-	status map[string]*Status = make(map[string]*Status)
+	// status follows the last job started on each server, by address; see
+	// jobStatus
+	status     map[string]*Status = make(map[string]*Status)
+	statusLock sync.Mutex
+
+	installs *installPool
+
+	installer  runner.Runner = &ansible.Ansible{}
+	waitForSSH               = runner.WaitForSSH
+
+	// letsEncryptStaging makes new deployments use test certificates by
+	// default; see CATGIRL_LETSENCRYPT_STAGING
+	letsEncryptStaging bool
+
+	// sshTimeout is how long a server gets to become reachable and finish
+	// booting before an install gives up on it
+	sshTimeout = 10 * time.Minute
+
+	// operatorToken lets operators see how busy the install queue is; see
+	// CATGIRL_OPERATOR_TOKEN
+	operatorToken string
+
+	// playbookDir is an on-disk copy of the playbook to use instead of the
+	// embedded one, for working on it without rebuilding
+	playbookDir string
 )
 
 func respondWithHTML(ctx *fiber.Ctx, html string) error {
@@ -91,11 +124,9 @@ func verifyDomain(ctx *fiber.Ctx, domain string) error {
 	return nil
 }
 
-func main() {
-	godotenv.Load()
-
-	SeedRNG()
-
+// newApp sets up the web app, with a fresh session store, around the runner,
+// pool and providers already configured.
+func newApp() *fiber.App {
 	app := fiber.New()
 	store = session.New()
 
@@ -162,13 +193,16 @@ func main() {
 			}
 		}
 
-		privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
-		if err != nil || privateKey.Validate() != nil {
-			log.Fatalf("Could not generate RSA keys: %v", err)
-			return nil
-		}
+		// users who brought their own key never get one generated for them
+		if session.Get("publicKey") == nil {
+			privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+			if err != nil || privateKey.Validate() != nil {
+				log.Fatalf("Could not generate RSA keys: %v", err)
+				return nil
+			}
 
-		session.Set("privateKey", privateKey)
+			session.Set("privateKey", privateKey)
+		}
 
 		session.Save()
 
@@ -177,10 +211,20 @@ func main() {
 			return nil
 		}
 
-		ctx.Redirect("/step/provision")
+		ctx.Redirect("/step/software")
 		return nil
 	})
 
+	// for operators only; without a token set, nobody gets to see it
+	app.Get("/queue", func(ctx *fiber.Ctx) error {
+		token := strings.TrimPrefix(ctx.Get("Authorization"), "Bearer ")
+		if operatorToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(operatorToken)) != 1 {
+			return ctx.SendStatus(404)
+		}
+
+		return ctx.JSON(installs.Stats())
+	})
+
 	app.Get("/contact", func(ctx *fiber.Ctx) error {
 		return respondWithHTML(ctx, templates.Contact)
 	})
@@ -189,8 +233,8 @@ func main() {
 		if strings.HasPrefix(string(ctx.Context().Path()), "/step/") {
 			session := ctx.Locals("session").(*session.Session)
 
-			if session.Get("provider") == nil || session.Get("accessToken") == nil || session.Get("privateKey") == nil {
-				log.Printf("Could not determine provider, accessToken, or privateKey: provider=%s, accessToken nil? %t, privateKey nil? %t", session.Get("provider"), session.Get("accessToken") == nil, session.Get("privateKey") == nil)
+			if session.Get("provider") == nil || session.Get("accessToken") == nil || (session.Get("privateKey") == nil && session.Get("publicKey") == nil) {
+				log.Printf("Could not determine provider, accessToken, or key: provider=%s, accessToken nil? %t, privateKey nil? %t, publicKey nil? %t", session.Get("provider"), session.Get("accessToken") == nil, session.Get("privateKey") == nil, session.Get("publicKey") == nil)
 				ctx.Redirect("/")
 				return nil
 			}
@@ -207,29 +251,89 @@ func main() {
 	})
 
 	app.Get("/step/download-key", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		if _, ok := ownPublicKey(session); ok {
+			return respondWithHTML(ctx, "You provided your own SSH public key, so there is no private key to download. Use the private key that belongs to it.")
+		}
+
 		ctx.Set("Content-Type", "application/octet-stream")
 		ctx.Set("Content-Disposition", "attachment; name=\"id_rsa\"; filename=\"id_rsa\"")
 
+		ctx.Write(privateKeyPEM(session))
+		return nil
+	})
+
+	app.Get("/step/software", func(ctx *fiber.Ctx) error {
 		session := ctx.Locals("session").(*session.Session)
 
-		ctx.Write(pem.EncodeToMemory(&pem.Block{
-			Type:    "RSA PRIVATE KEY",
-			Headers: nil,
-			Bytes:   x509.MarshalPKCS1PrivateKey(session.Get("privateKey").(*rsa.PrivateKey)),
-		}))
+		return respondWithHTML(ctx, softwareForm(session))
+	})
+
+	app.Post("/step/software", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		// the server is only set up once; what it runs can't change after that
+		if session.Get("ipv4") != nil {
+			ctx.Redirect("/step/install")
+			return nil
+		}
+
+		name := ctx.FormValue("Software")
+		if sw, ok := software[name]; !ok || !runs(sw.Playbook) {
+			return respondWithHTML(ctx, "<b>Error:</b> choose one of the options below.<br><br>"+softwareForm(session))
+		}
+
+		session.Set("software", name)
+		session.Save()
+
+		ctx.Redirect("/step/provision")
 		return nil
 	})
 
 	app.Get("/step/provision", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		if session.Get("software") == nil {
+			ctx.Redirect("/step/software")
+			return nil
+		}
+
 		return respondWithHTML(ctx, templates.Provision)
 	})
 
 	app.Post("/step/provision", func(ctx *fiber.Ctx) error {
 		session := ctx.Locals("session").(*session.Session)
 
-		publicKey, err := ssh.NewPublicKey(&session.Get("privateKey").(*rsa.PrivateKey).PublicKey)
+		if session.Get("software") == nil {
+			ctx.Redirect("/step/software")
+			return nil
+		}
+
+		input := &ProvisionInput{}
+		err := ctx.BodyParser(input)
 		if err != nil {
-			return respondWithHTML(ctx, fmt.Sprintf("Something went wrong when computing your private key. <a href='/login/%s'>Log in again</a> to generate a new one.", session.Get("provider")))
+			return errors.New("invalid form body")
+		}
+
+		var publicKey ssh.PublicKey
+		if strings.TrimSpace(input.PublicKey) != "" {
+			publicKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(input.PublicKey))
+			if err != nil {
+				return respondWithHTML(ctx, "<b>Error:</b> that doesn't look like an OpenSSH public key. Paste the contents of your <i>id_ed25519.pub</i> or <i>id_rsa.pub</i> file, or leave the field empty to have a key generated for you.<br><br>"+templates.Provision)
+			}
+
+			// the generated key is never registered anywhere, so there's no reason to keep it around
+			session.Set("publicKey", string(ssh.MarshalAuthorizedKey(publicKey)))
+			session.Delete("privateKey")
+			session.Save()
+		} else if pk, ok := ownPublicKey(session); ok {
+			publicKey = pk
+		} else {
+			publicKey, err = ssh.NewPublicKey(&session.Get("privateKey").(*rsa.PrivateKey).PublicKey)
+			if err != nil {
+				return respondWithHTML(ctx, fmt.Sprintf("Something went wrong when computing your private key. <a href='/login/%s'>Log in again</a> to generate a new one.", session.Get("provider")))
+			}
 		}
 
 		token := session.Get("accessToken").(string)
@@ -240,12 +344,28 @@ func main() {
 			return respondWithHTML(ctx, "Something went wrong adding the newly-created SSH key to your account. Check your provider's console and delete any SSH keys ending in '.fediverse.express' (or similar), then <form action='' method='post' style='display: inline;'><input type='submit' value='click here' /></form> to try again.")
 		}
 
-		ipv4, ipv6, err := providers[session.Get("provider").(string)].CreateServer(token, keyId)
+		// the server is sized for what's going to run on it
+		memory := software["misskey"].MinimumRAM
+		if sw, ok := software[session.Get("software").(string)]; ok {
+			memory = sw.MinimumRAM
+		}
+
+		ipv4, ipv6, err := providers[session.Get("provider").(string)].CreateServer(token, keyId, memory)
 		if err != nil {
 			log.Printf("Error provisioning server: %v", err)
 			return respondWithHTML(ctx, "Something went wrong when provisioning your server. Check your provider's console to make sure a machine hasn't been created. If it has, delete/unprovision it and click <form action='' method='post' style='display: inline;'><input type='submit' value='here' /></form> to try again.")
 		}
 
+		// a brand new server has nothing to do with whatever had its address
+		// before, so that one's record is put away and this one starts afresh
+		err = archiveDeployment(*ipv4)
+		if err != nil {
+			log.Printf("Error archiving deployment %s: %v", *ipv4, err)
+		}
+		if sx, ok := jobStatus(*ipv4); ok && sx.Finished() {
+			forgetStatus(*ipv4, sx)
+		}
+
 		session.Set("ipv4", ipv4)
 		session.Set("ipv6", ipv6)
 		session.Save()
@@ -317,22 +437,34 @@ func main() {
 
 		ipv4 := *session.Get("ipv4").(*string)
 
-		if sx, ok := status[ipv4]; ok {
-			if sx.Done {
+		if sx, ok := jobStatus(ipv4); ok {
+			if sx.Done() {
 				ctx.Redirect("/step/done")
 				return nil
 			}
 
-			if sx.Error != nil {
-				delete(status, ipv4)
+			if err := sx.Err(); err != nil {
+				forgetStatus(ipv4, sx)
 
-				return respondWithHTML(ctx, "<b>Error:</b> "+sx.Error.Error()+"<br><br>"+templates.Install)
+				// only a failed install needs installing again
+				if sx.Kind != "install" {
+					return respondWithHTML(ctx, "<b>Error:</b> "+err.Error()+"<br><br>"+installLog(ipv4)+"<a href=\"/step/done\">Back to your instance</a>")
+				}
+
+				return respondWithHTML(ctx, "<b>Error:</b> "+err.Error()+"<br><br>"+installLog(ipv4)+installForm(session))
 			}
 
-			return respondWithHTML(ctx, templates.Running)
+			// an upgrade stopped halfway leaves the instance down, so it can't
+			// be cancelled
+			cancel := ""
+			if sx.Kind != "upgrade" {
+				cancel = templates.RunningCancel
+			}
+
+			return respondWithHTML(ctx, fmt.Sprintf(templates.Running, cancel))
 		}
 
-		return respondWithHTML(ctx, templates.Install)
+		return respondWithHTML(ctx, installForm(session))
 	})
 
 	app.Post("/step/install", func(ctx *fiber.Ctx) error {
@@ -355,99 +487,324 @@ func main() {
 
 		ipv4 := session.Get("ipv4").(*string)
 
-		if sx, ok := status[*ipv4]; ok {
-			if !sx.Done && sx.Error != nil {
-				ctx.Redirect("/step/install")
-				return nil
+		// still running, waiting in the queue, or with an error yet to be shown
+		if sx, ok := jobStatus(*ipv4); ok && !sx.Done() {
+			ctx.Redirect("/step/install")
+			return nil
+		}
+
+		ex := func(html string) error {
+			return respondWithHTML(ctx, html+"<br><br>"+installForm(session))
+		}
+
+		if installs.Closed() {
+			return ex("fediverse.express is restarting and can't start new installations right now. Please try again in a few minutes.")
+		}
+
+		key, err := jobKey(ctx, session)
+		if err != nil {
+			return ex("<b>Error:</b> " + err.Error())
+		}
+
+		email := strings.TrimSpace(ctx.FormValue("Email"))
+		if err := validateEmail(email); err != nil {
+			return ex("<b>Error:</b> " + html.EscapeString(err.Error()))
+		}
+
+		deployment, err := loadDeployment(*ipv4)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Error loading deployment %s: %v", *ipv4, err)
+				return ex("An internal server error occured. Please try again.")
+			}
+
+			deployment = &Deployment{
+				IPv4: *ipv4,
+			}
+		}
+
+		if ipv6, ok := session.Get("ipv6").(*string); ok && ipv6 != nil {
+			deployment.IPv6 = *ipv6
+		}
+		deployment.Hostname = session.Get("hostname").(string)
+		deployment.Provider = session.Get("provider").(string)
+		deployment.Email = email
+
+		// what was picked only counts until something has been installed
+		if name, ok := session.Get("software").(string); ok && len(deployment.Jobs) == 0 {
+			deployment.Software = name
+		}
+
+		deployment.Staging = ctx.FormValue("Staging") != ""
+
+		sw := softwareOf(deployment)
+		if !runs(sw.Playbook) {
+			return ex("<b>Error:</b> " + sw.Name + " can't be installed from here right now.")
+		}
+
+		version := ""
+		if sw.Versions != nil {
+			if len(sw.Versions()) == 0 {
+				return ex("<b>Error:</b> the list of " + sw.Name + " releases couldn't be fetched right now. Please try again in a few minutes.")
+			}
+
+			version = ctx.FormValue("Version")
+			if version == "" || !sw.KnownVersion(version) && version != deployment.Version {
+				return ex("<b>Error:</b> choose one of the " + sw.Name + " versions offered.")
+			}
+		}
+
+		if customizable(sw) {
+			customization, err := readCustomization(ctx)
+			if err != nil {
+				return ex("<b>Error:</b> " + html.EscapeString(err.Error()))
 			}
+
+			deployment.Customization = customization
+		}
+
+		// pick up after a failed install if asked to; an empty role runs everything
+		from := ctx.FormValue("From")
+		if from != "" && from != deployment.ResumeRole() {
+			from = ""
+		}
+
+		spec := jobSpec{
+			Kind:    "install",
+			From:    from,
+			Version: version,
+		}
+		if from != "" {
+			spec.Roles = sw.RolesFrom(from)
+		}
+
+		_, err = startJob(deployment, key, spec)
+		if err != nil {
+			log.Printf("Error starting install on %s: %v", *ipv4, err)
+			return ex("An internal server error occured. Please try again.")
+		}
+
+		time.Sleep(2 * time.Second)
+		ctx.Redirect("/step/install")
+		return nil
+	})
+
+	app.Post("/step/certificate", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		if session.Get("ipv4") == nil {
+			ctx.Redirect("/step/provision")
+			return nil
+		}
+
+		ipv4 := session.Get("ipv4").(*string)
+
+		if sx, ok := jobStatus(*ipv4); ok && !sx.Done() {
+			ctx.Redirect("/step/install")
+			return nil
 		}
 
 		ex := func(html string) error {
-			return respondWithHTML(ctx, html+"<br><br>"+templates.Install)
+			return respondWithHTML(ctx, html+"<br><br><a href=\"/step/done\">Go back</a>")
+		}
+
+		if installs.Closed() {
+			return ex("fediverse.express is restarting and can't start new jobs right now. Please try again in a few minutes.")
+		}
+
+		deployment, err := loadDeployment(*ipv4)
+		if err != nil || deployment.Certificate != "staging" {
+			ctx.Redirect("/step/done")
+			return nil
 		}
 
-		// write ssh key
-		fx, err := os.Create(*ipv4 + ".key")
+		key, err := jobKey(ctx, session)
+		if err != nil {
+			return ex("<b>Error:</b> " + err.Error())
+		}
+
+		// only the nginx role deals with certificates
+		deployment.Staging = false
+
+		_, err = startJob(deployment, key, jobSpec{
+			Kind:  "certificate",
+			Roles: []string{"nginx"},
+		})
 		if err != nil {
-			log.Printf("Error creating file %s: %v", *ipv4+".key", err)
+			log.Printf("Error starting certificate job on %s: %v", *ipv4, err)
 			return ex("An internal server error occured. Please try again.")
 		}
-		defer fx.Close()
 
-		os.Chmod(*ipv4+".key", 0600)
+		ctx.Redirect("/step/install")
+		return nil
+	})
+
+	app.Post("/step/upgrade", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		if session.Get("ipv4") == nil {
+			ctx.Redirect("/step/provision")
+			return nil
+		}
+
+		ipv4 := session.Get("ipv4").(*string)
+
+		if sx, ok := jobStatus(*ipv4); ok && !sx.Done() {
+			ctx.Redirect("/step/install")
+			return nil
+		}
+
+		ex := func(html string) error {
+			return respondWithHTML(ctx, html+"<br><br><a href=\"/step/done\">Go back</a>")
+		}
+
+		if installs.Closed() {
+			return ex("fediverse.express is restarting and can't start new jobs right now. Please try again in a few minutes.")
+		}
+
+		deployment, err := loadDeployment(*ipv4)
+		if err != nil || !deployment.Installed() {
+			ctx.Redirect("/step/install")
+			return nil
+		}
+
+		sw := softwareOf(deployment)
+		if sw.UpgradePlaybook == "" || !runs(sw.UpgradePlaybook) {
+			ctx.Redirect("/step/done")
+			return nil
+		}
+
+		version := ctx.FormValue("Version")
+		if !sw.KnownVersion(version) {
+			return ex("<b>Error:</b> choose one of the " + sw.Name + " versions offered.")
+		}
+		if version == deployment.Version {
+			return ex("Your instance already runs " + sw.Name + " " + html.EscapeString(version) + ".")
+		}
+
+		key, err := jobKey(ctx, session)
+		if err != nil {
+			return ex("<b>Error:</b> " + err.Error())
+		}
 
-		err = pem.Encode(fx, &pem.Block{
-			Type:    "RSA PRIVATE KEY",
-			Headers: nil,
-			Bytes:   x509.MarshalPKCS1PrivateKey(session.Get("privateKey").(*rsa.PrivateKey)),
+		_, err = startJob(deployment, key, jobSpec{
+			Kind:     "upgrade",
+			Playbook: sw.UpgradePlaybook,
+			Roles:    sw.UpgradeRoles,
+			Version:  version,
 		})
 		if err != nil {
-			log.Printf("Error writing to file %s: %v", *ipv4+".key", err)
+			log.Printf("Error starting upgrade on %s: %v", *ipv4, err)
 			return ex("An internal server error occured. Please try again.")
 		}
 
-		provider := "" + session.Get("provider").(string)
+		ctx.Redirect("/step/install")
+		return nil
+	})
 
-		go func() {
-			status[*ipv4] = &Status{
-				Error: nil,
-				Done:  false,
-			}
+	app.Post("/step/install/cancel", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
 
-			defer func() {
-				err := os.Remove(*ipv4 + ".key")
-				if err != nil {
-					log.Printf("Error removing private key: %v", err)
-				}
-				err = os.Remove("catgirl/.catgirl/" + session.Get("hostname").(string) + "/postgresql")
-				if err != nil {
-					log.Printf("Error removing postgresql password: %v", err)
+		if session.Get("ipv4") == nil {
+			ctx.Redirect("/step/provision")
+			return nil
+		}
+
+		sx, ok := jobStatus(*session.Get("ipv4").(*string))
+		if ok && sx.Kind == "upgrade" {
+			return respondWithHTML(ctx, "Upgrades can't be cancelled, as stopping one halfway would leave your instance down. It will be done soon.<br><br><a href=\"/step/install\">Back to the upgrade</a>")
+		}
+
+		if ok && !sx.Finished() && sx.cancel != nil {
+			sx.cancel()
+
+			// if it was still waiting its turn, it can wrap up right away
+			installs.Dequeue(sx)
+		}
+
+		ctx.Redirect("/step/install")
+		return nil
+	})
+
+	app.Get("/step/install/log", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		if session.Get("ipv4") == nil {
+			return ctx.SendStatus(404)
+		}
+
+		deployment, err := loadDeployment(*session.Get("ipv4").(*string))
+		if err != nil || deployment.LastJob() == nil {
+			return ctx.SendStatus(404)
+		}
+
+		job := deployment.LastJob()
+
+		transcript, err := os.ReadFile(deployment.LogPath(job))
+		if err != nil {
+			return ctx.SendStatus(404)
+		}
+
+		ctx.Set("Content-Type", "text/plain; charset=utf-8")
+		ctx.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-%s-%s.log\"", deployment.Hostname, job.Kind, job.ID))
+
+		return ctx.Send(transcript)
+	})
+
+	app.Get("/step/install/events", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		if session.Get("ipv4") == nil {
+			return ctx.SendStatus(404)
+		}
+
+		sx, ok := jobStatus(*session.Get("ipv4").(*string))
+		if !ok || sx.Progress == nil {
+			return ctx.SendStatus(404)
+		}
+
+		ctx.Set("Content-Type", "text/event-stream")
+		ctx.Set("Cache-Control", "no-cache")
+		ctx.Set("Connection", "keep-alive")
+
+		ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			last := ""
+			idle := 0
+
+			for {
+				event := sx.Progress.Event()
+				event.Queued = installs.Position(sx)
+				event.Done = sx.Done()
+				if err := sx.Err(); err != nil {
+					event.Error = err.Error()
 				}
-				err = os.Remove("catgirl/.catgirl/" + session.Get("hostname").(string))
+
+				data, err := json.Marshal(event)
 				if err != nil {
-					log.Printf("Error removing catgirl settings directory: %v", err)
+					log.Printf("Error encoding progress: %v", err)
+					return
 				}
-			}()
-
-			// having nice things is STILL not allowed
-			user := "root"
-			if provider == "aws" {
-				user = "ubuntu"
-			}
 
-			ansible := ansibler.AnsiblePlaybookCmd{
-				CmdRunDir: "catgirl",
-				Playbook:  "main.yml",
-				Options: &ansibler.AnsiblePlaybookOptions{
-					ExtraVars: map[string]interface{}{
-						"domain": session.Get("hostname").(string),
-						"email":  "tb@gamers.exposed",
-					},
-					Inventory: *ipv4 + ",",
-				},
-				ConnectionOptions: &ansibler.AnsiblePlaybookConnectionOptions{
-					AskPass:    false,
-					User:       user,
-					PrivateKey: "../" + *ipv4 + ".key",
-				},
-				Writer: os.Stdout,
-			}
+				if string(data) != last || idle >= 15 {
+					fmt.Fprintf(w, "data: %s\n\n", data)
+					last = string(data)
+					idle = 0
+				}
 
-			ansibler.AnsibleAvoidHostKeyChecking()
+				// this is also how we find out the browser went away
+				if err := w.Flush(); err != nil {
+					return
+				}
 
-			err = ansible.Run()
-			if err != nil {
-				log.Printf("Ansible exited with error: %v", err)
+				if event.Done || event.Error != "" {
+					return
+				}
 
-				status[*ipv4].Error = fmt.Errorf("There was an error preparing your instance. Check that your server is on and working and try again. If this error persists, please e-mail us so we can help you out.")
-				return
+				idle++
+				time.Sleep(time.Second)
 			}
+		})
 
-			status[*ipv4].Done = true
-		}()
-
-		time.Sleep(2 * time.Second)
-		ctx.Redirect("/step/install")
 		return nil
 	})
 
@@ -466,21 +823,188 @@ func main() {
 
 		ipv4 := session.Get("ipv4").(*string)
 
-		if sx, ok := status[*ipv4]; ok {
-			if !sx.Done && sx.Error != nil {
+		if sx, ok := jobStatus(*ipv4); ok {
+			if sx.Err() != nil {
 				ctx.Redirect("/step/install")
 				return nil
 			}
 		}
 
-		pk := pem.EncodeToMemory(&pem.Block{
-			Type:    "RSA PRIVATE KEY",
-			Headers: nil,
-			Bytes:   x509.MarshalPKCS1PrivateKey(session.Get("privateKey").(*rsa.PrivateKey)),
-		})
+		deployment, err := loadDeployment(*ipv4)
+		if err != nil {
+			deployment = nil
+		}
+
+		// secrets that are only shown once are taken off the record the first
+		// time round, and kept with the session just long enough to go into
+		// the bundle
+		once := map[string]string{}
+		if sx, running := jobStatus(*ipv4); deployment != nil && (!running || sx.Done()) {
+			once = deployment.TakeCredentials(showOnce)
+			if len(once) > 0 {
+				err := saveDeployment(deployment)
+				if err != nil {
+					log.Printf("Error saving deployment %s: %v", *ipv4, err)
+				}
+
+				for name, value := range once {
+					session.Set("once:"+name, value)
+				}
+			}
+		}
+
+		hostname := session.Get("hostname").(string)
+		keyRow := doneRows(session, deployment, once, false)
+
+		if len(once) > 0 {
+			session.Save()
+		}
+
+		return respondWithHTML(ctx, fmt.Sprintf(templates.Done, hostname, *ipv4, keyRow, doneSteps(deployment)))
+	})
+
+	app.Get("/step/download-bundle", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+
+		if session.Get("ipv4") == nil || session.Get("hostname") == nil {
+			ctx.Redirect("/step/done")
+			return nil
+		}
+
+		ipv4 := session.Get("ipv4").(*string)
+		hostname := session.Get("hostname").(string)
+
+		deployment, err := loadDeployment(*ipv4)
+		if err != nil {
+			deployment = nil
+		}
+
+		// the one-time secrets go into the first bundle downloaded, and no other
+		once := map[string]string{}
+		for name := range showOnce {
+			if value, ok := session.Get("once:" + name).(string); ok {
+				once[name] = value
+				session.Delete("once:" + name)
+			}
+		}
+
+		keyRow := doneRows(session, deployment, once, true)
 
-		return respondWithHTML(ctx, fmt.Sprintf(templates.Done, session.Get("hostname").(string), *ipv4, string(pk), string(pk)))
+		if len(once) > 0 {
+			session.Save()
+		}
+
+		ctx.Set("Content-Type", "text/html")
+		ctx.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"fediverse.express-%s.html\"", strings.ReplaceAll(hostname, "\"", "")))
+
+		ctx.SendString(fmt.Sprintf("%s %s %s", templates.Header, fmt.Sprintf(templates.Done, hostname, *ipv4, keyRow, doneSteps(deployment)), templates.Footer))
+		return nil
 	})
 
-	app.Listen(":4000")
+	return app
+}
+
+func main() {
+	godotenv.Load()
+
+	if dir := os.Getenv("CATGIRL_DATA_DIR"); dir != "" {
+		dataDir = dir
+	}
+
+	workers := 2
+	if w := os.Getenv("CATGIRL_INSTALL_WORKERS"); w != "" {
+		n, err := strconv.Atoi(w)
+		if err != nil {
+			log.Fatalf("CATGIRL_INSTALL_WORKERS must be a number: %v", err)
+		}
+
+		workers = n
+	}
+
+	installs = newInstallPool(workers)
+
+	switch os.Getenv("CATGIRL_RUNNER") {
+	case "fake":
+		// the fake runner lets the whole flow be clicked through without installing anything
+		log.Printf("Using the fake runner; servers are still created, but nothing is installed on them")
+		f := fake.New(software["misskey"].Roles)
+		installer = f
+		waitForSSH = f.WaitForSSH
+	case "native":
+		log.Printf("Using the native runner; Ansible won't be used")
+		installer = &native.Native{}
+	}
+
+	if s := os.Getenv("CATGIRL_LETSENCRYPT_STAGING"); s != "" {
+		staging, err := strconv.ParseBool(s)
+		if err != nil {
+			log.Fatalf("CATGIRL_LETSENCRYPT_STAGING must be true or false: %v", err)
+		}
+
+		letsEncryptStaging = staging
+	}
+
+	if t := os.Getenv("CATGIRL_SSH_TIMEOUT"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			log.Fatalf("CATGIRL_SSH_TIMEOUT must be a duration such as 10m: %v", err)
+		}
+
+		sshTimeout = d
+	}
+
+	operatorToken = os.Getenv("CATGIRL_OPERATOR_TOKEN")
+
+	if dir := os.Getenv("CATGIRL_PLAYBOOK_DIR"); dir != "" {
+		log.Printf("Using the playbook in %s instead of the embedded one", dir)
+		playbookDir = dir
+	}
+
+	shutdownTimeout := 25 * time.Minute
+	if t := os.Getenv("CATGIRL_SHUTDOWN_TIMEOUT"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			log.Fatalf("CATGIRL_SHUTDOWN_TIMEOUT must be a duration such as 25m: %v", err)
+		}
+
+		shutdownTimeout = d
+	}
+
+	SeedRNG()
+
+	app := newApp()
+
+	go func() {
+		err := app.Listen(":4000")
+		if err != nil {
+			log.Fatalf("Could not listen: %v", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+
+	// keep serving progress pages while running installs finish up, but don't
+	// let anybody start a new one
+	log.Printf("Shutting down; waiting up to %s for running installs to finish", shutdownTimeout)
+	installs.Close()
+
+	if !installs.Wait(shutdownTimeout) {
+		log.Printf("Installs still running after %s, interrupting them", shutdownTimeout)
+		upgrades := installs.Interrupt()
+		installs.Wait(runner.StopGracePeriod + 5*time.Second)
+
+		if upgrades > 0 {
+			log.Printf("Waiting for %d running upgrades to finish", upgrades)
+			for !installs.Wait(time.Minute) {
+				log.Printf("Upgrades still running, waiting some more")
+			}
+		}
+	}
+
+	err := app.Shutdown()
+	if err != nil {
+		log.Printf("Error shutting down: %v", err)
+	}
 }
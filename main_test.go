@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CuteAP/fediverse.express/runner/fake"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"golang.org/x/oauth2"
+)
+
+// testProvider hands out a server at localhost, which is where localhost's
+// DNS points, so the whole flow can be followed without a real provider.
+type testProvider struct{}
+
+func (p *testProvider) OAuth2() *oauth2.Config {
+	return nil
+}
+
+func (p *testProvider) CreateSSHKey(token string, sshKey string) (interface{}, error) {
+	return "key", nil
+}
+
+func (p *testProvider) CreateServer(token string, sshKey interface{}, memory int) (*string, *string, error) {
+	ipv4, ipv6 := "127.0.0.1", "::1"
+	return &ipv4, &ipv6, nil
+}
+
+func (p *testProvider) EnterCredentials() (string, map[string]string) {
+	return "", nil
+}
+
+func (p *testProvider) ValidateCredentials(ctx *fiber.Ctx, session *session.Session) error {
+	return nil
+}
+
+var (
+	testKey     *rsa.PrivateKey
+	testKeyOnce sync.Once
+)
+
+// testApp sets up the app to run installs of sw with f, and returns it along
+// with the cookie of a session that has logged in and picked sw.
+func testApp(t *testing.T, f *fake.Fake, sw string) (*fiber.App, string) {
+	t.Helper()
+
+	oldDataDir, oldInstaller, oldWaitForSSH := dataDir, installer, waitForSSH
+	t.Cleanup(func() {
+		dataDir, installer, waitForSSH = oldDataDir, oldInstaller, oldWaitForSSH
+		delete(providers, "test")
+	})
+
+	dataDir = t.TempDir()
+	installer = f
+	waitForSSH = f.WaitForSSH
+	installs = newInstallPool(1)
+	status = make(map[string]*Status)
+	providers["test"] = &testProvider{}
+
+	// a small key is plenty for a fake server, and much quicker to make
+	testKeyOnce.Do(func() {
+		var err error
+		testKey, err = rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatalf("generating key: %v", err)
+		}
+	})
+
+	app := newApp()
+	app.Get("/test/login", func(ctx *fiber.Ctx) error {
+		session := ctx.Locals("session").(*session.Session)
+		session.Set("provider", "test")
+		session.Set("accessToken", "token")
+		session.Set("privateKey", testKey)
+		session.Set("software", sw)
+		session.Save()
+
+		return nil
+	})
+
+	resp := request(t, app, "", "GET", "/test/login", nil)
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session_id" {
+			return app, cookie.Name + "=" + cookie.Value
+		}
+	}
+
+	t.Fatal("logging in didn't set a session cookie")
+	return nil, ""
+}
+
+func request(t *testing.T, app *fiber.App, cookie string, method string, path string, form url.Values) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+
+	return resp
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+
+	return string(data)
+}
+
+// install goes through provisioning a server and starting an install on it.
+func install(t *testing.T, app *fiber.App, cookie string, form url.Values) {
+	t.Helper()
+
+	resp := request(t, app, cookie, "POST", "/step/provision", url.Values{"PublicKey": {""}})
+	if location := resp.Header.Get("Location"); location != "/step/verify" {
+		t.Fatalf("provisioning went to %q: %s", location, body(t, resp))
+	}
+
+	resp = request(t, app, cookie, "POST", "/step/verify", url.Values{"Hostname": {"localhost"}})
+	if location := resp.Header.Get("Location"); location != "/step/install" {
+		t.Fatalf("verifying went to %q: %s", location, body(t, resp))
+	}
+
+	startInstall(t, app, cookie, form)
+}
+
+func startInstall(t *testing.T, app *fiber.App, cookie string, form url.Values) {
+	t.Helper()
+
+	form.Set("Email", "admin@example.com")
+
+	resp := request(t, app, cookie, "POST", "/step/install", form)
+	if location := resp.Header.Get("Location"); location != "/step/install" {
+		t.Fatalf("installing went to %q: %s", location, body(t, resp))
+	}
+}
+
+// lastJob waits for the deployment's last job to finish and returns it.
+func lastJob(t *testing.T) *JobRecord {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		deployment, err := loadDeployment("127.0.0.1")
+		if err == nil && deployment.LastJob() != nil && !deployment.LastJob().Finished.IsZero() {
+			return deployment.LastJob()
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the job didn't finish in time")
+	return nil
+}
+
+func TestInstall(t *testing.T) {
+	f := fake.New(software["gotosocial"].Roles)
+	f.Delay = 0
+
+	app, cookie := testApp(t, f, "gotosocial")
+	install(t, app, cookie, url.Values{})
+
+	job := lastJob(t)
+	if job.Error != "" {
+		t.Fatalf("install failed: %s", job.Error)
+	}
+	if !reflect.DeepEqual(job.CompletedRoles, software["gotosocial"].Roles) {
+		t.Errorf("completed roles %v, want %v", job.CompletedRoles, software["gotosocial"].Roles)
+	}
+
+	if len(f.Jobs) != 1 || f.Jobs[0].Playbook != "gotosocial/main.yml" || f.Jobs[0].Tags != nil {
+		t.Errorf("fake ran %+v, want the whole GoToSocial playbook", f.Jobs)
+	}
+
+	resp := request(t, app, cookie, "GET", "/step/install", nil)
+	if location := resp.Header.Get("Location"); location != "/step/done" {
+		t.Errorf("install page went to %q, want the done page", location)
+	}
+
+	page := body(t, request(t, app, cookie, "GET", "/step/done", nil))
+	if !strings.Contains(page, "Congratulations") {
+		t.Errorf("done page doesn't congratulate: %s", page)
+	}
+	// the fake doesn't make an admin account
+	if strings.Contains(page, "Sign in to your admin account") {
+		t.Error("done page tells the user to sign in to an admin account that wasn't made")
+	}
+}
+
+func TestInstallEvents(t *testing.T) {
+	f := fake.New(software["gotosocial"].Roles)
+	f.Delay = 0
+
+	app, cookie := testApp(t, f, "gotosocial")
+	install(t, app, cookie, url.Values{})
+
+	resp := request(t, app, cookie, "GET", "/step/install/events", nil)
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events served as %q", resp.Header.Get("Content-Type"))
+	}
+
+	// the stream ends once the install does
+	var last ProgressEvent
+	for _, line := range strings.Split(body(t, resp), "\n") {
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &last); err != nil {
+			t.Fatalf("event %q: %v", line, err)
+		}
+	}
+
+	if !last.Done || last.Error != "" {
+		t.Fatalf("last event %+v, want the install to be done", last)
+	}
+	if last.Changed != len(f.Steps) || last.Failed != 0 {
+		t.Errorf("last event counted %d changed and %d failed, want all %d tasks changed", last.Changed, last.Failed, len(f.Steps))
+	}
+
+	// whoever hears it's done goes on to read the deployment record
+	deployment, err := loadDeployment("127.0.0.1")
+	if err != nil || deployment.LastJob().Finished.IsZero() {
+		t.Errorf("install said it was done before its record was saved: %v", err)
+	}
+}
+
+func TestInstallFailure(t *testing.T) {
+	f := fake.New(software["gotosocial"].Roles).FailAt("nginx", "certbot said no")
+	f.Delay = 0
+
+	app, cookie := testApp(t, f, "gotosocial")
+	install(t, app, cookie, url.Values{})
+
+	job := lastJob(t)
+	if !strings.Contains(job.Error, "certbot said no") {
+		t.Errorf("error %q doesn't say why", job.Error)
+	}
+	if job.FailedRole != "nginx" {
+		t.Errorf("failed role %q, want nginx", job.FailedRole)
+	}
+	if want := []string{"deps", "sys", "install"}; !reflect.DeepEqual(job.CompletedRoles, want) {
+		t.Errorf("completed roles %v, want %v", job.CompletedRoles, want)
+	}
+
+	page := body(t, request(t, app, cookie, "GET", "/step/install", nil))
+	if !strings.Contains(page, "certbot said no") || !strings.Contains(page, `value="nginx"`) {
+		t.Errorf("install page doesn't show the error and offer to resume: %s", page)
+	}
+
+	// resuming only runs what's left
+	f.FailAt("nginx", "")
+	startInstall(t, app, cookie, url.Values{"From": {"nginx"}})
+
+	job = lastJob(t)
+	if job.Error != "" {
+		t.Fatalf("resumed install failed: %s", job.Error)
+	}
+	if want := []string{"nginx", "post-install"}; len(f.Jobs) != 2 || !reflect.DeepEqual(f.Jobs[1].Tags, want) {
+		t.Errorf("resumed install ran %+v, want tags %v", f.Jobs, want)
+	}
+}
+
+func TestInstallUnreachable(t *testing.T) {
+	f := fake.New(software["gotosocial"].Roles)
+	f.Delay = 0
+	f.Steps[0].Unreachable = true
+	f.Steps[0].Fail = "connection refused"
+
+	app, cookie := testApp(t, f, "gotosocial")
+	install(t, app, cookie, url.Values{})
+
+	job := lastJob(t)
+	if !strings.Contains(job.Error, "Connecting to your server failed: connection refused") {
+		t.Errorf("error %q doesn't say the server couldn't be reached", job.Error)
+	}
+	if job.FailedRole != "deps" || len(job.CompletedRoles) != 0 {
+		t.Errorf("failed at %q after %v, want deps before anything was done", job.FailedRole, job.CompletedRoles)
+	}
+}
+
+func TestInstallCancel(t *testing.T) {
+	f := fake.New(software["gotosocial"].Roles)
+	f.Delay = time.Minute
+
+	app, cookie := testApp(t, f, "gotosocial")
+	install(t, app, cookie, url.Values{})
+
+	page := body(t, request(t, app, cookie, "GET", "/step/install", nil))
+	if !strings.Contains(page, "/step/install/cancel") {
+		t.Errorf("running install can't be cancelled: %s", page)
+	}
+
+	request(t, app, cookie, "POST", "/step/install/cancel", nil)
+
+	job := lastJob(t)
+	if !job.Cancelled {
+		t.Errorf("job wasn't recorded as cancelled: %+v", job)
+	}
+
+	page = body(t, request(t, app, cookie, "GET", "/step/install", nil))
+	if !strings.Contains(page, "You cancelled the installation") {
+		t.Errorf("install page doesn't say it was cancelled: %s", page)
+	}
+}
+
+func TestQueueNeedsToken(t *testing.T) {
+	f := fake.New(software["gotosocial"].Roles)
+	app, _ := testApp(t, f, "gotosocial")
+
+	old := operatorToken
+	defer func() { operatorToken = old }()
+
+	queue := func(authorization string) int {
+		req, _ := http.NewRequest("GET", "/queue", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	operatorToken = ""
+	if code := queue("Bearer "); code != 404 {
+		t.Errorf("queue served with no token set: %d", code)
+	}
+
+	operatorToken = "operator"
+	if code := queue(""); code != 404 {
+		t.Errorf("queue served without a token: %d", code)
+	}
+	if code := queue("Bearer wrong"); code != 404 {
+		t.Errorf("queue served with the wrong token: %d", code)
+	}
+	if code := queue("Bearer operator"); code != 200 {
+		t.Errorf("queue not served with the right token: %d", code)
+	}
+}
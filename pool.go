@@ -0,0 +1,198 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// installPool runs install jobs in the order they were started, never more
+// than workers at a time. Everybody else waits their turn in the queue.
+type installPool struct {
+	sync.Mutex
+
+	workers int
+	running int
+	queue   []*queuedInstall
+	active  map[*Status]bool
+	closed  bool
+}
+
+type queuedInstall struct {
+	status *Status
+	run    func()
+}
+
+// QueueStats is what operators get to see of the install queue.
+type QueueStats struct {
+	Workers int `json:"workers"`
+	Running int `json:"running"`
+	Queued  int `json:"queued"`
+}
+
+func newInstallPool(workers int) *installPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &installPool{
+		workers: workers,
+		active:  make(map[*Status]bool),
+	}
+}
+
+// Enqueue adds a job to the back of the queue, starting it right away if there
+// is a worker free. Once the pool is closed, jobs are interrupted before they
+// get to start.
+func (p *installPool) Enqueue(sx *Status, run func()) {
+	p.Lock()
+	defer p.Unlock()
+
+	queued := &queuedInstall{
+		status: sx,
+		run:    run,
+	}
+
+	if p.closed {
+		sx.interrupt()
+		p.start(queued)
+		return
+	}
+
+	p.queue = append(p.queue, queued)
+
+	log.Printf("Install queued: %d running, %d waiting", p.running, len(p.queue))
+
+	p.dispatch()
+}
+
+// dispatch starts queued jobs while there are workers free. The lock must be held.
+func (p *installPool) dispatch() {
+	for p.running < p.workers && len(p.queue) > 0 {
+		next := p.queue[0]
+		p.queue = p.queue[1:]
+		p.start(next)
+	}
+}
+
+// start runs a job, keeping count of it until it is done. The lock must be held.
+func (p *installPool) start(job *queuedInstall) {
+	p.running++
+	p.active[job.status] = true
+
+	go func() {
+		job.run()
+
+		p.Lock()
+		defer p.Unlock()
+
+		p.running--
+		delete(p.active, job.status)
+		p.dispatch()
+	}()
+}
+
+// Position returns how many jobs are ahead of sx in the queue, counting itself,
+// or zero if it isn't waiting.
+func (p *installPool) Position(sx *Status) int {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, queued := range p.queue {
+		if queued.status == sx {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
+// Dequeue takes a job out of the queue before it gets to run, and runs it
+// right away so it can wrap up. It reports whether sx was waiting.
+func (p *installPool) Dequeue(sx *Status) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, queued := range p.queue {
+		if queued.status == sx {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			p.start(queued)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Stats returns how busy the pool is.
+func (p *installPool) Stats() QueueStats {
+	p.Lock()
+	defer p.Unlock()
+
+	return QueueStats{
+		Workers: p.workers,
+		Running: p.running,
+		Queued:  len(p.queue),
+	}
+}
+
+// Closed tells whether the pool has stopped taking new jobs.
+func (p *installPool) Closed() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.closed
+}
+
+// Close stops the pool from taking new jobs. Jobs still waiting in the queue
+// would never get their turn, so they are interrupted.
+func (p *installPool) Close() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.closed = true
+
+	queue := p.queue
+	p.queue = nil
+
+	for _, queued := range queue {
+		queued.status.interrupt()
+		p.start(queued)
+	}
+}
+
+// Wait blocks until no jobs are running, giving up after timeout. It reports
+// whether the pool drained in time.
+func (p *installPool) Wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if p.Stats().Running == 0 {
+			return true
+		}
+
+		time.Sleep(time.Second)
+	}
+
+	return p.Stats().Running == 0
+}
+
+// Interrupt stops every running install. Upgrades are left to finish, or to
+// roll back, as one stopped halfway would leave the instance down; it returns
+// how many of those are still running.
+func (p *installPool) Interrupt() int {
+	p.Lock()
+	defer p.Unlock()
+
+	upgrades := 0
+	for sx := range p.active {
+		if sx.Kind == "upgrade" {
+			upgrades++
+			continue
+		}
+
+		sx.interrupt()
+	}
+
+	return upgrades
+}
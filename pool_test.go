@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInstallPoolOrder(t *testing.T) {
+	p := newInstallPool(1)
+
+	release := make(chan bool)
+	started := make(chan int, 5)
+	var wg sync.WaitGroup
+
+	statuses := []*Status{}
+	for i := 0; i < 5; i++ {
+		i := i
+		sx := &Status{}
+		statuses = append(statuses, sx)
+
+		wg.Add(1)
+		p.Enqueue(sx, func() {
+			defer wg.Done()
+
+			started <- i
+			<-release
+		})
+	}
+
+	if stats := p.Stats(); stats.Running != 1 || stats.Queued != 4 {
+		t.Errorf("stats %+v, want 1 running and 4 queued", stats)
+	}
+	if pos := p.Position(statuses[3]); pos != 3 {
+		t.Errorf("fourth job is number %d in line, want 3", pos)
+	}
+	if pos := p.Position(statuses[0]); pos != 0 {
+		t.Errorf("running job is number %d in line, want 0", pos)
+	}
+
+	order := []int{}
+	for i := 0; i < 5; i++ {
+		select {
+		case n := <-started:
+			order = append(order, n)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %v started", order)
+		}
+
+		release <- true
+	}
+	wg.Wait()
+
+	if want := []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(order, want) {
+		t.Errorf("jobs ran in order %v, want %v", order, want)
+	}
+}
+
+func TestInstallPoolClose(t *testing.T) {
+	p := newInstallPool(1)
+
+	release := make(chan bool)
+	running, waiting := &Status{}, &Status{}
+
+	p.Enqueue(running, func() { <-release })
+	p.Enqueue(waiting, func() {})
+
+	p.Close()
+
+	if !waiting.Interrupted() || running.Interrupted() {
+		t.Errorf("closing interrupted running=%t, waiting=%t, want only the waiting job", running.Interrupted(), waiting.Interrupted())
+	}
+
+	close(release)
+	if !p.Wait(5 * time.Second) {
+		t.Error("pool didn't drain")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Progress follows a playbook run as it happens.
+type Progress struct {
+	sync.Mutex
+
+	Role    string
+	Task    string
+	Ok      int
+	Changed int
+	Failed  int
+	Skipped int
+
+	// roles are the roles the run goes through, in order
+	roles     []string
+	completed []string
+	failure   *TaskFailure
+}
+
+// TaskFailure describes the task that made a playbook run fail.
+type TaskFailure struct {
+	Role    string
+	Task    string
+	Host    string
+	Module  string
+	Message string
+}
+
+func (f *TaskFailure) Error() string {
+	return fmt.Sprintf("%s failed: %s", f.Task, f.Message)
+}
+
+// ProgressEvent is what gets sent to the browser while an install runs.
+type ProgressEvent struct {
+	Role      string `json:"role"`
+	Task      string `json:"task"`
+	RolesDone int    `json:"rolesDone"`
+	Roles     int    `json:"roles"`
+	Ok        int    `json:"ok"`
+	Changed   int    `json:"changed"`
+	Failed    int    `json:"failed"`
+	Queued    int    `json:"queued"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Event takes a snapshot of the progress made so far.
+func (p *Progress) Event() ProgressEvent {
+	p.Lock()
+	defer p.Unlock()
+
+	rolesDone := 0
+	for i, role := range p.roles {
+		if role == p.Role {
+			rolesDone = i
+		}
+	}
+
+	return ProgressEvent{
+		Role:      p.Role,
+		Task:      p.Task,
+		RolesDone: rolesDone,
+		Roles:     len(p.roles),
+		Ok:        p.Ok,
+		Changed:   p.Changed,
+		Failed:    p.Failed,
+	}
+}
+
+// CompletedRoles returns the roles that have run to completion so far.
+func (p *Progress) CompletedRoles() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	return append([]string{}, p.completed...)
+}
+
+// SetTask shows what is going on before the playbook gets to its first task.
+func (p *Progress) SetTask(task string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.Task = task
+}
+
+// FailedRole returns the role that was running when the playbook failed.
+func (p *Progress) FailedRole() string {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.failure != nil && p.failure.Role != "" {
+		return p.failure.Role
+	}
+
+	return p.Role
+}
+
+// Failure returns the first task that failed, if any did.
+func (p *Progress) Failure() *TaskFailure {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.failure
+}
+
+// playbookEvent is a single line of output from the ansible.posix.jsonl callback.
+type playbookEvent struct {
+	Event string `json:"_event"`
+	Task  *struct {
+		Name string `json:"name"`
+	} `json:"task"`
+	Hosts map[string]*hostResult `json:"hosts"`
+	Stats map[string]*hostStats  `json:"stats"`
+}
+
+type hostResult struct {
+	Action       string        `json:"action"`
+	Changed      bool          `json:"changed"`
+	Failed       bool          `json:"failed"`
+	IgnoreErrors bool          `json:"ignore_errors"`
+	Msg          interface{}   `json:"msg"`
+	Stdout       string        `json:"stdout"`
+	Stderr       string        `json:"stderr"`
+	Results      []*hostResult `json:"results"`
+}
+
+type hostStats struct {
+	Ok          int `json:"ok"`
+	Changed     int `json:"changed"`
+	Failures    int `json:"failures"`
+	Skipped     int `json:"skipped"`
+	Unreachable int `json:"unreachable"`
+}
+
+// message digs the most useful explanation out of a task result.
+func (r *hostResult) message() string {
+	// loops only say that "one or more items failed"
+	for _, item := range r.Results {
+		if item.Failed {
+			return item.message()
+		}
+	}
+
+	msg := ""
+	switch m := r.Msg.(type) {
+	case string:
+		msg = m
+	case nil:
+	default:
+		msg = fmt.Sprint(m)
+	}
+
+	if r.Stderr != "" && (msg == "" || msg == "non-zero return code") {
+		lines := strings.Split(strings.TrimSpace(r.Stderr), "\n")
+		msg = lines[len(lines)-1]
+	}
+
+	return strings.TrimSpace(msg)
+}
+
+// output returns everything a failed command printed, for the log.
+func (r *hostResult) output() string {
+	out := ""
+
+	if r.Stdout != "" {
+		out += "stdout:\n" + strings.TrimRight(r.Stdout, "\n") + "\n"
+	}
+	if r.Stderr != "" {
+		out += "stderr:\n" + strings.TrimRight(r.Stderr, "\n") + "\n"
+	}
+
+	for _, item := range r.Results {
+		if item.Failed {
+			out += item.output()
+		}
+	}
+
+	return out
+}
+
+// splitTaskName separates the role from a task name printed as "role : task".
+func splitTaskName(name string) (string, string) {
+	if i := strings.Index(name, " : "); i > -1 {
+		return name[:i], name[i+3:]
+	}
+
+	return "", name
+}
+
+// parse updates the progress from a single event, returning a human-readable
+// version of it for the log.
+func (p *Progress) parse(event *playbookEvent) string {
+	p.Lock()
+	defer p.Unlock()
+
+	switch event.Event {
+	case "v2_playbook_on_task_start":
+		if event.Task == nil {
+			return ""
+		}
+
+		role, task := splitTaskName(event.Task.Name)
+		if role != "" && role != p.Role {
+			// roles run one after the other, so the last one is done
+			if p.Role != "" && p.failure == nil {
+				p.completed = append(p.completed, p.Role)
+			}
+
+			p.Role = role
+		}
+		p.Task = task
+
+		return fmt.Sprintf("TASK [%s]", event.Task.Name)
+	case "v2_runner_on_ok", "v2_runner_on_failed", "v2_runner_on_unreachable", "v2_runner_on_skipped":
+		out := ""
+
+		for host, result := range event.Hosts {
+			switch event.Event {
+			case "v2_runner_on_ok":
+				if result.Changed {
+					p.Changed++
+					out += fmt.Sprintf("changed: [%s]\n", host)
+				} else {
+					p.Ok++
+					out += fmt.Sprintf("ok: [%s]\n", host)
+				}
+			case "v2_runner_on_skipped":
+				p.Skipped++
+				out += fmt.Sprintf("skipping: [%s]\n", host)
+			case "v2_runner_on_failed", "v2_runner_on_unreachable":
+				if result.IgnoreErrors {
+					out += fmt.Sprintf("failed: [%s]: %s (ignored)\n", host, result.message())
+					continue
+				}
+
+				p.Failed++
+
+				role, task := "", ""
+				if event.Task != nil {
+					role, task = splitTaskName(event.Task.Name)
+				}
+
+				if event.Event == "v2_runner_on_unreachable" {
+					task = "Connecting to your server"
+				}
+
+				if p.failure == nil {
+					p.failure = &TaskFailure{
+						Role:    role,
+						Task:    task,
+						Host:    host,
+						Module:  result.Action,
+						Message: result.message(),
+					}
+				}
+
+				out += fmt.Sprintf("fatal: [%s]: FAILED! => %s\n", host, result.message())
+				out += result.output()
+			}
+		}
+
+		return strings.TrimSuffix(out, "\n")
+	case "v2_playbook_on_stats":
+		out := "PLAY RECAP"
+
+		for host, stats := range event.Stats {
+			p.Ok = stats.Ok
+			p.Changed = stats.Changed
+			p.Failed = stats.Failures
+			p.Skipped = stats.Skipped
+
+			out += fmt.Sprintf("\n%s : ok=%d changed=%d unreachable=%d failed=%d skipped=%d", host, stats.Ok, stats.Changed, stats.Unreachable, stats.Failures, stats.Skipped)
+		}
+
+		return out
+	}
+
+	return ""
+}
+
+// progressWriter reads the event stream from ansible-playbook, keeping track
+// of the progress it reports and logging a readable transcript to out.
+type progressWriter struct {
+	progress *Progress
+	out      io.Writer
+	buf      []byte
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := w.buf[:i]
+		w.buf = w.buf[i+1:]
+
+		event := &playbookEvent{}
+		if err := json.Unmarshal(line, event); err != nil || event.Event == "" {
+			// warnings and the like aren't events; pass them along as they are
+			fmt.Fprintf(w.out, "%s\n", line)
+			continue
+		}
+
+		if text := w.progress.parse(event); text != "" {
+			fmt.Fprintf(w.out, "%s\n", text)
+		}
+	}
+
+	return len(b), nil
+}
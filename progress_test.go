@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProgressParse(t *testing.T) {
+	p := &Progress{roles: []string{"deps", "sys", "install"}}
+	out := &bytes.Buffer{}
+	w := &progressWriter{progress: p, out: out}
+
+	events := []string{
+		`{"_event": "v2_playbook_on_task_start", "task": {"name": "deps : Install packages"}}`,
+		`{"_event": "v2_runner_on_ok", "task": {"name": "deps : Install packages"}, "hosts": {"192.0.2.1": {"action": "apt", "changed": true}}}`,
+		`{"_event": "v2_playbook_on_task_start", "task": {"name": "sys : Add user"}}`,
+		`{"_event": "v2_runner_on_ok", "task": {"name": "sys : Add user"}, "hosts": {"192.0.2.1": {"action": "user"}}}`,
+		`[WARNING]: not an event`,
+		`{"_event": "v2_playbook_on_task_start", "task": {"name": "install : Build"}}`,
+		`{"_event": "v2_runner_on_failed", "task": {"name": "install : Build"}, "hosts": {"192.0.2.1": {"action": "command", "failed": true, "msg": "non-zero return code", "stdout": "building", "stderr": "warning\nout of memory\n"}}}`,
+	}
+
+	// the stream may be split anywhere
+	stream := strings.Join(events, "\n") + "\n"
+	w.Write([]byte(stream[:50]))
+	w.Write([]byte(stream[50:]))
+
+	if p.Role != "install" || p.Task != "Build" {
+		t.Errorf("at %s : %s, want install : Build", p.Role, p.Task)
+	}
+	if p.Changed != 1 || p.Ok != 1 || p.Failed != 1 {
+		t.Errorf("counted %d ok, %d changed, %d failed, want one each", p.Ok, p.Changed, p.Failed)
+	}
+
+	// a failed role isn't done
+	if want := []string{"deps", "sys"}; !reflect.DeepEqual(p.CompletedRoles(), want) {
+		t.Errorf("completed roles %v, want %v", p.CompletedRoles(), want)
+	}
+	if p.FailedRole() != "install" {
+		t.Errorf("failed role %q, want install", p.FailedRole())
+	}
+
+	failure := p.Failure()
+	if failure == nil || failure.Task != "Build" || failure.Module != "command" || failure.Message != "out of memory" {
+		t.Errorf("failure %+v, want Build failing with the last line of stderr", failure)
+	}
+
+	if event := p.Event(); event.RolesDone != 2 || event.Roles != 3 {
+		t.Errorf("event says %d of %d roles done, want 2 of 3", event.RolesDone, event.Roles)
+	}
+
+	for _, line := range []string{"TASK [deps : Install packages]", "changed: [192.0.2.1]", "[WARNING]: not an event", "fatal: [192.0.2.1]: FAILED! => out of memory", "stdout:\nbuilding"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("transcript is missing %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestProgressParseUnreachable(t *testing.T) {
+	p := &Progress{roles: []string{"deps"}}
+
+	p.parse(&playbookEvent{Event: "v2_playbook_on_task_start", Task: &struct {
+		Name string `json:"name"`
+	}{"deps : Gather facts"}})
+	p.parse(&playbookEvent{Event: "v2_runner_on_unreachable", Hosts: map[string]*hostResult{
+		"192.0.2.1": {Msg: "Connection timed out"},
+	}})
+
+	failure := p.Failure()
+	if failure == nil || failure.Task != "Connecting to your server" || failure.Message != "Connection timed out" {
+		t.Errorf("failure %+v, want the connection to have failed", failure)
+	}
+	if p.FailedRole() != "deps" {
+		t.Errorf("failed role %q, want deps", p.FailedRole())
+	}
+}
+
+func TestProgressParseIgnoredErrors(t *testing.T) {
+	p := &Progress{roles: []string{"deps"}}
+
+	text := p.parse(&playbookEvent{Event: "v2_runner_on_failed", Hosts: map[string]*hostResult{
+		"192.0.2.1": {Failed: true, IgnoreErrors: true, Msg: "no such service"},
+	}})
+
+	if p.Failed != 0 || p.Failure() != nil {
+		t.Errorf("ignored error counted as a failure")
+	}
+	if !strings.Contains(text, "(ignored)") {
+		t.Errorf("transcript %q doesn't say the error was ignored", text)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/CuteAP/fediverse.express/runner"
+)
+
+const redacted = "[REDACTED]"
+
+// redactingWriter masks secrets in a transcript before passing it on. Secrets
+// the playbook generates itself only show up on disk partway through a run, so
+// their files are checked for again until they have been found.
+type redactingWriter struct {
+	out         io.Writer
+	secrets     []string
+	secretFiles []string
+}
+
+func (w *redactingWriter) load() {
+	missing := []string{}
+
+	for _, path := range w.secretFiles {
+		secret, err := os.ReadFile(path)
+		if err != nil {
+			missing = append(missing, path)
+			continue
+		}
+
+		s := runner.ParseSecret(secret)
+		if s != "" {
+			w.secrets = append(w.secrets, s)
+		}
+	}
+
+	w.secretFiles = missing
+}
+
+func (w *redactingWriter) Write(b []byte) (int, error) {
+	if len(w.secretFiles) > 0 {
+		w.load()
+	}
+
+	out := b
+	for _, secret := range w.secrets {
+		out = bytes.ReplaceAll(out, []byte(secret), []byte(redacted))
+	}
+
+	_, err := w.out.Write(out)
+	return len(b), err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	dir := t.TempDir()
+	generated := filepath.Join(dir, "postgresql")
+
+	out := &bytes.Buffer{}
+	w := &redactingWriter{
+		out:         out,
+		secrets:     []string{"hunter2"},
+		secretFiles: []string{generated},
+	}
+
+	w.Write([]byte("password is hunter2\n"))
+
+	// the playbook generates its secrets partway through
+	err := os.WriteFile(generated, []byte("s3cret salt=abcdef\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := w.Write([]byte("database password s3cret\n"))
+	if err != nil || n != len("database password s3cret\n") {
+		t.Errorf("Write returned %d, %v", n, err)
+	}
+
+	want := "password is [REDACTED]\ndatabase password [REDACTED]\n"
+	if out.String() != want {
+		t.Errorf("wrote %q, want %q", out.String(), want)
+	}
+	if len(w.secretFiles) != 0 {
+		t.Errorf("still looking for %v after finding them", w.secretFiles)
+	}
+}
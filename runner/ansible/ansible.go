@@ -0,0 +1,121 @@
+package ansible
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/CuteAP/fediverse.express/runner"
+	ansibler "github.com/apenella/go-ansible"
+	"github.com/apenella/go-ansible/stdoutcallback"
+)
+
+// jsonlCallback streams one JSON document per playbook event, which is what
+// lets us follow an install task by task.
+const jsonlCallback = "ansible.posix.jsonl"
+
+// Ansible runs playbooks with ansible-playbook.
+type Ansible struct{}
+
+func (a *Ansible) Run(ctx context.Context, job *runner.Job) error {
+	inventory := filepath.Join(job.WorkDir, "inventory")
+	err := os.WriteFile(inventory, []byte(job.Host+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	knownHosts, err := job.KnownHosts()
+	if err != nil {
+		return err
+	}
+
+	knownHostsPath := filepath.Join(job.WorkDir, "known_hosts")
+	err = os.WriteFile(knownHostsPath, knownHosts, 0600)
+	if err != nil {
+		return err
+	}
+
+	vars := map[string]interface{}{
+		"secrets_dir":             job.SecretsDir(),
+		"ansible_ssh_common_args": "-o StrictHostKeyChecking=yes -o GlobalKnownHostsFile=/dev/null -o UserKnownHostsFile=" + knownHostsPath,
+	}
+	for k, v := range job.Vars {
+		vars[k] = v
+	}
+
+	ansible := ansibler.AnsiblePlaybookCmd{
+		Exec: &executor{
+			ctx: ctx,
+			job: job,
+		},
+		Playbook: job.Playbook,
+		Options: &ansibler.AnsiblePlaybookOptions{
+			ExtraVars: vars,
+			Inventory: inventory,
+			Tags:      strings.Join(job.Tags, ","),
+		},
+		ConnectionOptions: &ansibler.AnsiblePlaybookConnectionOptions{
+			AskPass:    false,
+			User:       job.User,
+			PrivateKey: job.PrivateKey,
+		},
+	}
+
+	return ansible.Run()
+}
+
+// executor runs ansible-playbook with the jsonl stdout callback. go-ansible
+// only knows about its own list of callbacks and resets the environment to the
+// default one otherwise, so the callback is set on the command itself.
+type executor struct {
+	ctx context.Context
+	job *runner.Job
+}
+
+func (e *executor) Execute(command string, args []string, prefix string) error {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = e.job.Dir
+	cmd.Env = append(os.Environ(),
+		stdoutcallback.AnsibleStdoutCallbackEnv+"="+jsonlCallback,
+		ansibler.AnsibleHostKeyCheckingEnv+"=true",
+	)
+	cmd.Stdout = e.job.Writer
+	cmd.Stderr = e.job.Writer
+	// ansible forks workers and ssh connections; give them a process group so
+	// they can be stopped together
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-e.ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		case <-done:
+			return
+		}
+
+		select {
+		case <-time.After(runner.StopGracePeriod):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	if e.ctx.Err() != nil {
+		return e.ctx.Err()
+	}
+
+	return err
+}
@@ -0,0 +1,178 @@
+package fake
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CuteAP/fediverse.express/runner"
+	"golang.org/x/crypto/ssh"
+)
+
+// Step is a single scripted task.
+type Step struct {
+	Role    string
+	Task    string
+	Changed bool
+	// Fail makes the task fail with this message.
+	Fail string
+	// Unreachable makes the task fail as if the server couldn't be reached.
+	Unreachable bool
+}
+
+// Fake plays back a script of tasks instead of touching a server, so the
+// install flow can be exercised without one.
+type Fake struct {
+	Steps []Step
+	// Delay is how long each task takes.
+	Delay time.Duration
+
+	// Jobs records every job the fake was asked to run.
+	Jobs []*runner.Job
+	lock sync.Mutex
+}
+
+// New returns a fake that runs a task in each role and succeeds.
+func New(roles []string) *Fake {
+	f := &Fake{
+		Delay: time.Second,
+	}
+
+	for _, role := range roles {
+		f.Steps = append(f.Steps, Step{
+			Role:    role,
+			Task:    "Pretend to set up " + role,
+			Changed: true,
+		})
+	}
+
+	return f
+}
+
+// FailAt makes the scripted task in role fail with msg.
+func (f *Fake) FailAt(role string, msg string) *Fake {
+	for i := range f.Steps {
+		if f.Steps[i].Role == role {
+			f.Steps[i].Fail = msg
+		}
+	}
+
+	return f
+}
+
+// WaitForSSH stands in for runner.WaitForSSH. The server is always ready, and
+// gets a made-up host key if it has none.
+func (f *Fake) WaitForSSH(ctx context.Context, job *runner.Job, timeout time.Duration) error {
+	if job.HostKey != "" {
+		return nil
+	}
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return err
+	}
+
+	job.HostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	return nil
+}
+
+func (f *Fake) Run(ctx context.Context, job *runner.Job) error {
+	f.lock.Lock()
+	f.Jobs = append(f.Jobs, job)
+	f.lock.Unlock()
+
+	stats := map[string]int{}
+
+	for _, step := range f.Steps {
+		if !job.Tagged(step.Role) {
+			continue
+		}
+
+		name := step.Task
+		if step.Role != "" {
+			name = step.Role + " : " + step.Task
+		}
+		task := map[string]interface{}{
+			"name": name,
+		}
+
+		f.emit(job, map[string]interface{}{
+			"_event": "v2_playbook_on_task_start",
+			"task":   task,
+		})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.Delay):
+		}
+
+		result := map[string]interface{}{
+			"action":  "command",
+			"changed": step.Changed,
+		}
+		event := "v2_runner_on_ok"
+
+		switch {
+		case step.Unreachable:
+			event = "v2_runner_on_unreachable"
+			result["msg"] = step.Fail
+			stats["unreachable"]++
+		case step.Fail != "":
+			event = "v2_runner_on_failed"
+			result["failed"] = true
+			result["msg"] = step.Fail
+			stats["failures"]++
+		case step.Changed:
+			stats["changed"]++
+			stats["ok"]++
+		default:
+			stats["ok"]++
+		}
+
+		f.emit(job, map[string]interface{}{
+			"_event": event,
+			"task":   task,
+			"hosts": map[string]interface{}{
+				job.Host: result,
+			},
+		})
+
+		if event != "v2_runner_on_ok" {
+			f.emitStats(job, stats)
+			return fmt.Errorf("%s failed: %s", name, step.Fail)
+		}
+	}
+
+	f.emitStats(job, stats)
+	return nil
+}
+
+func (f *Fake) emitStats(job *runner.Job, stats map[string]int) {
+	f.emit(job, map[string]interface{}{
+		"_event": "v2_playbook_on_stats",
+		"stats": map[string]interface{}{
+			job.Host: stats,
+		},
+	})
+}
+
+func (f *Fake) emit(job *runner.Job, event map[string]interface{}) {
+	if job.Writer == nil {
+		return
+	}
+
+	// nothing in here can fail to encode
+	data, _ := json.Marshal(event)
+	job.Writer.Write(append(data, '\n'))
+}
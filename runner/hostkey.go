@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyMismatch means the server presented a different host key than the
+// one pinned for it.
+var ErrHostKeyMismatch = errors.New("the server's SSH host key has changed")
+
+// hostKey parses the job's pinned host key.
+func (j *Job) hostKey() (ssh.PublicKey, error) {
+	if j.HostKey == "" {
+		return nil, errors.New("no host key pinned for " + j.Host)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(j.HostKey))
+	return key, err
+}
+
+// KnownHosts returns a known_hosts file trusting only the job's pinned host key.
+func (j *Job) KnownHosts() ([]byte, error) {
+	key, err := j.hostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(knownhosts.Line([]string{j.Host}, key) + "\n"), nil
+}
+
+// HostKeyCallback accepts only the job's pinned host key.
+func (j *Job) HostKeyCallback() (ssh.HostKeyCallback, error) {
+	key, err := j.hostKey()
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := ssh.FixedHostKey(key)
+
+	return func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+		if fixed(hostname, remote, k) != nil {
+			return ErrHostKeyMismatch
+		}
+
+		return nil
+	}, nil
+}
+
+// Dial logs in to the job's server with its key, checking the pinned host key.
+func Dial(ctx context.Context, job *Job) (*ssh.Client, error) {
+	hostKeyCallback, err := job.HostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	return dial(ctx, job, hostKeyCallback)
+}
+
+func dial(ctx context.Context, job *Job, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+	key, err := os.ReadFile(job.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(job.Host, "22")
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:            job.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
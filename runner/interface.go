@@ -0,0 +1,80 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StopGracePeriod is how long a runner gives a cancelled job to wrap up before
+// it is stopped for good.
+const StopGracePeriod = 10 * time.Second
+
+// Job describes a single playbook run against a server.
+type Job struct {
+	// Dir is the directory holding the playbook.
+	Dir      string
+	Playbook string
+
+	Host       string
+	User       string
+	PrivateKey string
+	// HostKey is the server's pinned SSH host key, in authorized_keys format.
+	// Runners refuse to talk to a server presenting any other.
+	HostKey string
+
+	// WorkDir is a directory private to this job, for the runner's own files
+	// and the secrets the run generates. It is wiped once the job is done.
+	WorkDir string
+
+	Vars map[string]interface{}
+	// Tags limits the run to the roles tagged with these names. Empty runs everything.
+	Tags []string
+
+	// Writer receives the run's events, one ansible.posix.jsonl document per line.
+	Writer io.Writer
+}
+
+// SecretsDir is where the run keeps the secrets it generates, one per file.
+func (j *Job) SecretsDir() string {
+	return filepath.Join(j.WorkDir, "secrets")
+}
+
+// Tagged tells whether a role would run given the job's tags.
+func (j *Job) Tagged(role string) bool {
+	if len(j.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range j.Tags {
+		if tag == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseSecret reads a secret out of a file in the secrets directory. Ansible's
+// password lookup keeps the salt on the same line, after the password.
+func ParseSecret(data []byte) string {
+	return strings.TrimSpace(strings.SplitN(string(data), " salt=", 2)[0])
+}
+
+// Runner runs playbooks. Cancelling the context stops the run.
+type Runner interface {
+	Run(ctx context.Context, job *Job) error
+}
+
+// Limited is implemented by runners that can't run every playbook, or don't
+// act on every variable. Runners that don't implement it are taken to do
+// everything the playbooks do.
+type Limited interface {
+	// Supports tells whether the runner can run a playbook, by its path
+	// relative to the playbook directory.
+	Supports(playbook string) bool
+	// Understands tells whether the runner acts on a variable.
+	Understands(variable string) bool
+}
@@ -0,0 +1,310 @@
+package native
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CuteAP/fediverse.express/runner"
+	"golang.org/x/crypto/ssh"
+)
+
+// Native runs the playbook's roles itself over SSH, for hosts that would
+// rather not have Python and Ansible installed. It reports its progress in the
+// same format as ansible.posix.jsonl, so the rest of the install flow can't
+// tell the difference.
+type Native struct{}
+
+// Step is a single idempotent piece of a role, run as a shell script on the server.
+type Step struct {
+	Role   string
+	Name   string
+	Script func(vars *Vars) (string, error)
+	// After, if set, gets to look at what the script printed once it has run
+	// successfully.
+	After func(vars *Vars, output string) error
+}
+
+// Vars are what the steps get to work with.
+type Vars struct {
+	Domain   string
+	Email    string
+	Playbook string
+	// Version is the Misskey release, or branch, to check out.
+	Version string
+	// IDGeneration is the scheme Misskey makes up IDs with.
+	IDGeneration string
+	// Proxy is the HTTP proxy Misskey goes through, if any.
+	Proxy string
+	// ProxyRemoteFiles serves remote media through the instance.
+	ProxyRemoteFiles bool
+
+	// Staging gets a test certificate from Let's Encrypt's staging environment.
+	Staging bool
+	// ForceRenewal replaces the certificate even if it isn't due yet.
+	ForceRenewal bool
+
+	// Secrets is the job's secrets directory.
+	Secrets string
+	// DatabasePassword is read from, or generated into, Secrets, the same as
+	// the playbook's password lookup does.
+	DatabasePassword string
+}
+
+// Playbook stands in for one of catgirl's playbooks.
+type Playbook struct {
+	Steps []Step
+	// Rescue runs if any of the steps fail, to put things back the way they were.
+	Rescue []Step
+}
+
+// playbooks are the playbooks Native knows how to run, by file name.
+var playbooks = map[string]*Playbook{
+	"main.yml":    {Steps: steps},
+	"upgrade.yml": {Steps: upgradeSteps, Rescue: upgradeRescue},
+}
+
+// Supports tells whether there are steps standing in for a playbook.
+func (n *Native) Supports(playbook string) bool {
+	_, ok := playbooks[playbook]
+	return ok
+}
+
+// understood are the variables loadVars picks up; anything else is ignored.
+var understood = map[string]bool{
+	"domain":                     true,
+	"email":                      true,
+	"misskey_version":            true,
+	"misskey_id":                 true,
+	"misskey_proxy":              true,
+	"misskey_proxy_remote_files": true,
+	"staging":                    true,
+	"certbot_force":              true,
+}
+
+// Understands tells whether loadVars picks up a variable.
+func (n *Native) Understands(variable string) bool {
+	return understood[variable]
+}
+
+func (n *Native) Run(ctx context.Context, job *runner.Job) error {
+	playbook, ok := playbooks[job.Playbook]
+	if !ok {
+		return fmt.Errorf("native: no steps for playbook %s", job.Playbook)
+	}
+
+	vars, err := loadVars(job)
+	if err != nil {
+		return err
+	}
+
+	client, err := runner.Dial(ctx, job)
+	if err != nil {
+		emit(job, "v2_runner_on_unreachable", "", map[string]interface{}{
+			"msg":         err.Error(),
+			"unreachable": true,
+		})
+		emitStats(job, map[string]int{"unreachable": 1})
+		return err
+	}
+	defer client.Close()
+
+	stats := map[string]int{}
+
+	err = runSteps(ctx, client, job, vars, playbook.Steps, stats)
+	if err != nil && ctx.Err() == nil && playbook.Rescue != nil {
+		// the run has failed either way; the rescue only limits the damage
+		rescueErr := runSteps(ctx, client, job, vars, playbook.Rescue, stats)
+		if rescueErr != nil {
+			err = fmt.Errorf("%v, and putting things back failed too: %v", err, rescueErr)
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	emitStats(job, stats)
+	return err
+}
+
+// runSteps runs the steps the job's tags ask for, stopping at the first one
+// that fails.
+func runSteps(ctx context.Context, client *ssh.Client, job *runner.Job, vars *Vars, steps []Step, stats map[string]int) error {
+	for _, step := range steps {
+		if !job.Tagged(step.Role) {
+			continue
+		}
+
+		name := step.Role + " : " + step.Name
+		emit(job, "v2_playbook_on_task_start", name, nil)
+
+		script, err := step.Script(vars)
+		if err == nil {
+			var output string
+			output, err = execute(ctx, client, job.User, script)
+			if err == nil && step.After != nil {
+				err = step.After(vars, output)
+			}
+
+			if err == nil {
+				stats["ok"]++
+				emit(job, "v2_runner_on_ok", name, map[string]interface{}{
+					"action": "shell",
+					"stdout": output,
+				})
+				continue
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			stats["failures"]++
+			emit(job, "v2_runner_on_failed", name, map[string]interface{}{
+				"action": "shell",
+				"failed": true,
+				"msg":    "non-zero return code",
+				"stderr": output,
+			})
+		} else {
+			stats["failures"]++
+			emit(job, "v2_runner_on_failed", name, map[string]interface{}{
+				"action": "shell",
+				"failed": true,
+				"msg":    err.Error(),
+			})
+		}
+
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	return nil
+}
+
+// execute runs a script as root, returning everything it printed. The script
+// runs on a terminal so that hanging up on it stops it too.
+func execute(ctx context.Context, client *ssh.Client, user string, script string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	err = session.RequestPty("dumb", 40, 200, ssh.TerminalModes{ssh.ECHO: 0})
+	if err != nil {
+		return "", err
+	}
+
+	output := &bytes.Buffer{}
+	session.Stdout = output
+	session.Stderr = output
+
+	command := "bash -c " + quote(preamble+script)
+	if user != "root" {
+		command = "sudo -n " + command
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case <-ctx.Done():
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+
+		select {
+		case <-done:
+		case <-time.After(runner.StopGracePeriod):
+		}
+
+		return "", ctx.Err()
+	case err = <-done:
+		return strings.ReplaceAll(output.String(), "\r\n", "\n"), err
+	}
+}
+
+func loadVars(job *runner.Job) (*Vars, error) {
+	vars := &Vars{
+		Playbook: job.Dir,
+		Secrets:  job.SecretsDir(),
+	}
+
+	var ok bool
+	if vars.Domain, ok = job.Vars["domain"].(string); !ok {
+		return nil, errors.New("native: job has no domain")
+	}
+	if vars.Email, ok = job.Vars["email"].(string); !ok {
+		return nil, errors.New("native: job has no email")
+	}
+	vars.Version, _ = job.Vars["misskey_version"].(string)
+	if vars.Version == "" {
+		vars.Version = "master"
+	}
+	vars.IDGeneration, _ = job.Vars["misskey_id"].(string)
+	if vars.IDGeneration == "" {
+		vars.IDGeneration = "aid"
+	}
+	vars.Proxy, _ = job.Vars["misskey_proxy"].(string)
+	if vars.ProxyRemoteFiles, ok = job.Vars["misskey_proxy_remote_files"].(bool); !ok {
+		vars.ProxyRemoteFiles = true
+	}
+	vars.Staging, _ = job.Vars["staging"].(bool)
+	vars.ForceRenewal, _ = job.Vars["certbot_force"].(bool)
+
+	password, err := secret(vars.Secrets, "postgresql", 40)
+	if err != nil {
+		return nil, err
+	}
+	vars.DatabasePassword = password
+
+	return vars, nil
+}
+
+func emit(job *runner.Job, event string, task string, result map[string]interface{}) {
+	if job.Writer == nil {
+		return
+	}
+
+	doc := map[string]interface{}{
+		"_event": event,
+	}
+	if task != "" {
+		doc["task"] = map[string]interface{}{
+			"name": task,
+		}
+	}
+	if result != nil {
+		doc["hosts"] = map[string]interface{}{
+			job.Host: result,
+		}
+	}
+
+	// nothing in here can fail to encode
+	data, _ := json.Marshal(doc)
+	job.Writer.Write(append(data, '\n'))
+}
+
+func emitStats(job *runner.Job, stats map[string]int) {
+	if job.Writer == nil {
+		return
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"_event": "v2_playbook_on_stats",
+		"stats": map[string]interface{}{
+			job.Host: stats,
+		},
+	})
+	job.Writer.Write(append(data, '\n'))
+}
+
+// quote makes s safe to pass as a single shell word.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
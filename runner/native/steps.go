@@ -0,0 +1,371 @@
+package native
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/CuteAP/fediverse.express/runner"
+)
+
+// preamble is put in front of every step's script.
+const preamble = `set -euo pipefail
+export DEBIAN_FRONTEND=noninteractive
+`
+
+const passwordChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// secret mirrors the playbook's lookup('password', ...): the password is kept
+// in a file in the secrets directory and only generated if there is none.
+func secret(secrets string, name string, length int) (string, error) {
+	path := filepath.Join(secrets, name)
+
+	existing, err := os.ReadFile(path)
+	if err == nil {
+		return runner.ParseSecret(existing), nil
+	}
+
+	password := ""
+	for len(password) < length {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordChars))))
+		if err != nil {
+			return "", err
+		}
+		password += string(passwordChars[n.Int64()])
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	return password, os.WriteFile(path, []byte(password+"\n"), 0600)
+}
+
+// validateConfig is the check catgirl/roles/install runs on default.yml before
+// it is put in place.
+const validateConfig = `import sys, yaml
+c = yaml.safe_load(open(sys.argv[1]))
+assert c['url'] == sys.argv[2], 'url is ' + str(c['url'])
+assert c['port'] and c['id'], 'port or id missing'
+assert all(c['db'].get(k) for k in ('host', 'port', 'db', 'user', 'pass')), 'database settings missing'
+assert all(c['redis'].get(k) for k in ('host', 'port')), 'redis settings missing'`
+
+// misskeyConfig writes out what catgirl/roles/install/templates/default.yml.j2
+// does. Strings go in as JSON, which YAML reads the same way.
+func misskeyConfig(vars *Vars) string {
+	str := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+
+	config := `url: ` + str("https://"+vars.Domain+"/") + `
+port: 3000
+
+db:
+  host: localhost
+  port: 5432
+  db: "misskey"
+  user: "misskey"
+  pass: ` + str(vars.DatabasePassword) + `
+
+redis:
+  host: localhost
+  port: 6379
+
+id: ` + str(vars.IDGeneration) + `
+
+proxyRemoteFiles: ` + strconv.FormatBool(vars.ProxyRemoteFiles) + `
+`
+
+	if vars.Proxy != "" {
+		config += `proxy: ` + str(vars.Proxy) + `
+`
+	}
+
+	return config
+}
+
+// script returns a step that always runs the same script.
+func script(s string) func(*Vars) (string, error) {
+	return func(*Vars) (string, error) {
+		return s, nil
+	}
+}
+
+// recordCommit keeps the commit a step says it checked out, as the playbook's
+// "Note the commit" tasks do: tags can be moved, so what was actually
+// installed is kept too.
+func recordCommit(vars *Vars, output string) error {
+	for _, line := range strings.Split(output, "\n") {
+		if commit := strings.TrimPrefix(line, "commit "); commit != line {
+			return os.WriteFile(filepath.Join(vars.Secrets, "misskey_commit"), []byte(commit), 0600)
+		}
+	}
+
+	return errors.New("the commit that was checked out couldn't be found")
+}
+
+// steps follows catgirl/roles, task for task where it makes sense.
+var steps = []Step{
+	// deps
+	{
+		Role:   "deps",
+		Name:   "Ensure systemd-timesyncd is running correctly",
+		Script: script(`systemctl restart systemd-timesyncd`),
+	},
+	{
+		Role:   "deps",
+		Name:   "Stop the Misskey service, if exists",
+		Script: script(`if systemctl is-enabled --quiet misskey 2>/dev/null; then systemctl stop misskey; fi`),
+	},
+	{
+		Role: "deps",
+		Name: "Install PostgreSQL and NodeSource APT repositories",
+		Script: script(`apt-get install -y curl gnupg lsb-release
+curl -fsSL https://www.postgresql.org/media/keys/ACCC4CF8.asc | apt-key add -
+curl -fsSL https://deb.nodesource.com/gpgkey/nodesource.gpg.key | apt-key add -
+echo "deb https://apt.postgresql.org/pub/repos/apt $(lsb_release -cs)-pgdg main" > /etc/apt/sources.list.d/pgdg.list
+echo "deb https://deb.nodesource.com/node_16.x $(lsb_release -cs) main" > /etc/apt/sources.list.d/nodesource.list
+apt-get update`),
+	},
+	{
+		Role:   "deps",
+		Name:   "Ensure all packages are updated",
+		Script: script(`apt-get install -y nginx postgresql nodejs redis-server python3-psycopg2 acl build-essential`),
+	},
+	{
+		Role:   "deps",
+		Name:   "Install Certbot snap",
+		Script: script(`snap list certbot >/dev/null 2>&1 || snap install --classic certbot`),
+	},
+	{
+		Role:   "deps",
+		Name:   "Ensure all dependent services are started",
+		Script: script(`systemctl enable --now nginx postgresql redis-server`),
+	},
+
+	// sys
+	{
+		Role: "sys",
+		Name: "Add Misskey user",
+		Script: script(`getent group misskey >/dev/null || groupadd --system misskey
+id misskey >/dev/null 2>&1 || useradd --system --gid misskey --comment Misskey --no-create-home --shell /bin/false misskey`),
+	},
+	{
+		Role: "sys",
+		Name: "Set up firewall",
+		Script: script(`ufw allow OpenSSH
+ufw allow 80
+ufw allow 443
+ufw default deny
+ufw --force enable`),
+	},
+
+	// postgres
+	{
+		Role:   "postgres",
+		Name:   "Create Misskey database",
+		Script: script(`sudo -u postgres psql -tAc "SELECT 1 FROM pg_database WHERE datname = 'misskey'" | grep -q 1 || sudo -u postgres createdb misskey`),
+	},
+	{
+		Role: "postgres",
+		Name: "Create Misskey PostgreSQL role",
+		Script: func(vars *Vars) (string, error) {
+			return `sudo -u postgres psql -v ON_ERROR_STOP=1 -d misskey <<'SQL'
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'misskey') THEN
+		CREATE ROLE misskey LOGIN;
+	END IF;
+END $$;
+ALTER ROLE misskey WITH LOGIN PASSWORD '` + vars.DatabasePassword + `' VALID UNTIL 'infinity';
+SQL`, nil
+		},
+	},
+	{
+		Role:   "postgres",
+		Name:   "Grant permissions to Misskey PostgreSQL role",
+		Script: script(`sudo -u postgres psql -v ON_ERROR_STOP=1 -d misskey -c "GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO misskey"`),
+	},
+
+	// install
+	{
+		Role: "install",
+		Name: "Clone Misskey",
+		Script: func(vars *Vars) (string, error) {
+			return `mkdir -p /opt/misskey
+chown misskey /opt/misskey
+chmod 0755 /opt/misskey
+if [ -d /opt/misskey/.git ]; then
+	sudo -u misskey git -C /opt/misskey fetch --force --tags origin
+else
+	sudo -u misskey git clone https://github.com/syuilo/misskey.git /opt/misskey
+fi
+ref=` + quote(vars.Version) + `
+# branches move, so take the remote's idea of them
+if sudo -u misskey git -C /opt/misskey rev-parse -q --verify "refs/remotes/origin/$ref" >/dev/null; then
+	ref="origin/$ref"
+fi
+sudo -u misskey git -C /opt/misskey checkout -f --detach "$ref"
+echo "commit $(sudo -u misskey git -C /opt/misskey rev-parse HEAD)"`, nil
+		},
+		After: recordCommit,
+	},
+	{
+		Role:   "install",
+		Name:   "Install Misskey npm dependencies (this will take a moment...)",
+		Script: script(`cd /opt/misskey && sudo -u misskey npx -y yarn`),
+	},
+	{
+		Role: "install",
+		Name: "Configure Misskey",
+		Script: func(vars *Vars) (string, error) {
+			return `umask 077
+sudo -u misskey tee /opt/misskey/.config/default.yml.new >/dev/null <<'EOF'
+` + misskeyConfig(vars) + `EOF
+sudo -u misskey python3 -c ` + quote(validateConfig) + ` /opt/misskey/.config/default.yml.new ` + quote("https://"+vars.Domain+"/") + `
+sudo -u misskey mv /opt/misskey/.config/default.yml.new /opt/misskey/.config/default.yml`, nil
+		},
+	},
+	{
+		Role:   "install",
+		Name:   "Build Misskey (this will take a moment...)",
+		Script: script(`cd /opt/misskey && sudo -u misskey env NODE_ENV=production npx -y yarn build`),
+	},
+	{
+		Role:   "install",
+		Name:   "Run migrations",
+		Script: script(`cd /opt/misskey && sudo -u misskey npx yarn migrate`),
+	},
+
+	// nginx
+	{
+		Role: "nginx",
+		Name: "Obtain certificate",
+		Script: func(vars *Vars) (string, error) {
+			command := `/snap/bin/certbot certonly -n --agree-tos -m ` + quote(vars.Email) + ` --webroot -w /var/www/html -d ` + quote(vars.Domain)
+			if vars.Staging {
+				command += ` --staging --break-my-certs`
+			}
+			if vars.ForceRenewal {
+				command += ` --force-renewal`
+			}
+
+			return command, nil
+		},
+	},
+	{
+		Role: "nginx",
+		Name: "Configure nginx",
+		Script: func(vars *Vars) (string, error) {
+			return `cp /opt/misskey/docs/examples/misskey.nginx /etc/nginx/sites-available/misskey.conf
+sed -i ` + quote(`s/example\.tld/`+vars.Domain+`/g`) + ` /etc/nginx/sites-available/misskey.conf
+ln -sf /etc/nginx/sites-available/misskey.conf /etc/nginx/sites-enabled/misskey.conf`, nil
+		},
+	},
+	{
+		Role:   "nginx",
+		Name:   "Restart nginx",
+		Script: script(`systemctl enable nginx && systemctl restart nginx`),
+	},
+
+	// post-install
+	{
+		Role: "post-install",
+		Name: "Copy Misskey service",
+		Script: func(vars *Vars) (string, error) {
+			unit, err := os.ReadFile(filepath.Join(vars.Playbook, "files", "misskey.service"))
+			if err != nil {
+				return "", err
+			}
+
+			return `cat > /etc/systemd/system/misskey.service <<'UNIT'
+` + string(unit) + `
+UNIT
+systemctl daemon-reload`, nil
+		},
+	},
+	{
+		Role:   "post-install",
+		Name:   "Restart Misskey service",
+		Script: script(`systemctl enable misskey && systemctl restart misskey`),
+	},
+	{
+		Role: "post-install",
+		Name: "Wait for Misskey to start",
+		Script: script(`for i in $(seq 30); do
+  curl -fsS -o /dev/null -X POST -H 'Content-Type: application/json' -d '{}' http://127.0.0.1:3000/api/meta && exit 0
+  sleep 5
+done
+exit 1`),
+	},
+	{
+		// only the very first account can be made this way; see
+		// catgirl/roles/post-install/tasks/admin.yml
+		Role: "post-install",
+		Name: "Create admin account",
+		Script: func(vars *Vars) (string, error) {
+			password, err := secret(vars.Secrets, "admin_password", 24)
+			if err != nil {
+				return "", err
+			}
+
+			body, _ := json.Marshal(map[string]string{
+				"username": "admin",
+				"password": password,
+			})
+
+			return `token=/opt/misskey/.config/admin-token
+if [ -f "$token" ]; then
+  echo "admin account exists"
+  exit 0
+fi
+
+response=$(curl -sS -w '\n%{http_code}' -X POST -H 'Content-Type: application/json' -d @- http://127.0.0.1:3000/api/admin/accounts/create <<'JSON'
+` + string(body) + `
+JSON
+)
+status=${response##*$'\n'}
+response=${response%$'\n'*}
+
+# Misskey refuses with "access denied" once anybody has signed up; anything
+# else went wrong some other way
+if [ "$status" != 200 ]; then
+  if printf '%s' "$response" | grep -q 'access denied'; then
+    echo "admin account taken"
+    exit 0
+  fi
+
+  echo "Misskey couldn't create the admin account (HTTP status $status)" >&2
+  exit 1
+fi
+
+umask 077
+printf '%s' "$response" | node -e 'let d = ""; process.stdin.on("data", c => d += c).on("end", () => process.stdout.write(JSON.parse(d).token))' > "$token"
+chown misskey:misskey "$token"
+echo "admin account created"`, nil
+		},
+		// somebody beat us to it, so the password that was made up is no good
+		After: func(vars *Vars, output string) error {
+			if strings.Contains(output, "admin account created") {
+				return nil
+			}
+
+			err := os.Remove(filepath.Join(vars.Secrets, "admin_password"))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			if strings.Contains(output, "admin account taken") {
+				return os.WriteFile(filepath.Join(vars.Secrets, "admin_taken"), []byte("yes"), 0600)
+			}
+
+			return nil
+		},
+	},
+}
@@ -0,0 +1,103 @@
+package native
+
+// where the upgrade keeps what it needs to roll back
+const (
+	previousVersionFile = "/var/backups/misskey-pre-upgrade.ref"
+	databaseDumpFile    = "/var/lib/postgresql/misskey-pre-upgrade.dump"
+)
+
+// upgradeSteps follows catgirl/roles/upgrade.
+var upgradeSteps = []Step{
+	{
+		Role: "upgrade",
+		Name: "Find the installed Misskey version",
+		Script: script(`rm -f ` + databaseDumpFile + ` ` + databaseDumpFile + `.tmp ` + previousVersionFile + `
+sudo -u misskey git -C /opt/misskey rev-parse HEAD > ` + previousVersionFile),
+	},
+	{
+		Role:   "upgrade",
+		Name:   "Stop the Misskey service",
+		Script: script(`systemctl stop misskey`),
+	},
+	{
+		Role: "upgrade",
+		Name: "Back up the database",
+		// the dump only takes its place once it's complete, so a restore
+		// never starts from half of one
+		Script: script(`sudo -u postgres pg_dump --format=custom --file=` + databaseDumpFile + `.tmp misskey
+mv ` + databaseDumpFile + `.tmp ` + databaseDumpFile),
+	},
+	{
+		Role: "upgrade",
+		Name: "Fetch Misskey",
+		Script: func(vars *Vars) (string, error) {
+			return `sudo -u misskey git -C /opt/misskey fetch --force --tags origin
+ref=` + quote(vars.Version) + `
+if sudo -u misskey git -C /opt/misskey rev-parse -q --verify "refs/remotes/origin/$ref" >/dev/null; then
+	ref="origin/$ref"
+fi
+sudo -u misskey git -C /opt/misskey checkout -f --detach "$ref"
+echo "commit $(sudo -u misskey git -C /opt/misskey rev-parse HEAD)"`, nil
+		},
+		After: recordCommit,
+	},
+	{
+		Role:   "upgrade",
+		Name:   "Install Misskey npm dependencies (this will take a moment...)",
+		Script: script(`cd /opt/misskey && sudo -u misskey npx -y yarn`),
+	},
+	{
+		Role:   "upgrade",
+		Name:   "Build Misskey (this will take a moment...)",
+		Script: script(`cd /opt/misskey && sudo -u misskey env NODE_ENV=production npx -y yarn build`),
+	},
+	{
+		Role:   "upgrade",
+		Name:   "Run migrations",
+		Script: script(`cd /opt/misskey && sudo -u misskey npx yarn migrate`),
+	},
+	{
+		Role:   "upgrade",
+		Name:   "Start the Misskey service",
+		Script: script(`systemctl start misskey`),
+	},
+}
+
+// upgradeRescue puts back whatever the upgrade got around to changing. Nothing
+// is changed until the database is backed up, so without a finished backup
+// Misskey only needs starting again.
+var upgradeRescue = []Step{
+	{
+		Role: "upgrade",
+		Name: "Roll back to the previous Misskey version",
+		Script: script(`if [ -s ` + databaseDumpFile + ` ] && [ -s ` + previousVersionFile + ` ]; then
+	sudo -u misskey git -C /opt/misskey checkout -f --detach "$(cat ` + previousVersionFile + `)"
+fi`),
+	},
+	{
+		Role: "upgrade",
+		Name: "Restore the database",
+		Script: script(`if [ -s ` + databaseDumpFile + ` ]; then
+	sudo -u postgres pg_restore --clean --if-exists --dbname=misskey ` + databaseDumpFile + `
+fi`),
+	},
+	{
+		Role: "upgrade",
+		Name: "Reinstall the previous npm dependencies (this will take a moment...)",
+		Script: script(`if [ -s ` + databaseDumpFile + ` ]; then
+	cd /opt/misskey && sudo -u misskey npx -y yarn
+fi`),
+	},
+	{
+		Role: "upgrade",
+		Name: "Rebuild the previous version (this will take a moment...)",
+		Script: script(`if [ -s ` + databaseDumpFile + ` ]; then
+	cd /opt/misskey && sudo -u misskey env NODE_ENV=production npx -y yarn build
+fi`),
+	},
+	{
+		Role:   "upgrade",
+		Name:   "Start the Misskey service",
+		Script: script(`systemctl start misskey`),
+	},
+}
@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How far WaitForSSH got with a server before giving up on it.
+const (
+	// StagePort means nothing was listening on port 22.
+	StagePort = "port"
+	// StageLogin means the server wouldn't let us log in with the job's key.
+	StageLogin = "login"
+	// StageBusy means cloud-init or package updates were still going.
+	StageBusy = "busy"
+)
+
+// waitScript returns once the server is done setting itself up: cloud-init has
+// finished and nothing is holding on to the package manager.
+const waitScript = `if command -v cloud-init >/dev/null; then cloud-init status --wait >/dev/null || true; fi
+if command -v fuser >/dev/null; then
+	while fuser /var/lib/dpkg/lock-frontend /var/lib/dpkg/lock /var/lib/apt/lists/lock >/dev/null 2>&1; do sleep 5; done
+fi`
+
+// NotReadyError is returned when a server isn't ready for a job in time.
+type NotReadyError struct {
+	Stage string
+	Err   error
+}
+
+func (e *NotReadyError) Error() string {
+	return "server not ready (" + e.Stage + "): " + e.Err.Error()
+}
+
+func (e *NotReadyError) Unwrap() error {
+	return e.Err
+}
+
+// WaitForSSH waits until the job's server takes SSH logins and is done setting
+// itself up, for up to timeout. If the job has no host key pinned yet, the
+// one the server presents once it is ready gets pinned.
+func WaitForSSH(ctx context.Context, job *Job, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		stage, err := probe(waitCtx, job)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// a swapped server won't fix itself
+		if errors.Is(err, ErrHostKeyMismatch) || strings.Contains(err.Error(), ErrHostKeyMismatch.Error()) {
+			return &NotReadyError{Stage: StageLogin, Err: ErrHostKeyMismatch}
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return &NotReadyError{Stage: stage, Err: err}
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// probe tries once to get through every stage, saying which one it got stuck at.
+func probe(ctx context.Context, job *Job) (string, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(job.Host, "22"))
+	if err != nil {
+		return StagePort, err
+	}
+	conn.Close()
+
+	// host keys may still be regenerated during first boot, so the key is
+	// only pinned once the server has settled down. It's the one presented on
+	// the connection that logged in and waited, so it belongs to the server
+	// our key was accepted by.
+	var seen ssh.PublicKey
+	var hostKeyCallback ssh.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		seen = key
+		return nil
+	}
+	if job.HostKey != "" {
+		hostKeyCallback, err = job.HostKeyCallback()
+		if err != nil {
+			return StageLogin, err
+		}
+	}
+
+	client, err := dial(ctx, job, hostKeyCallback)
+	if err != nil {
+		return StageLogin, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return StageLogin, err
+	}
+	defer session.Close()
+
+	command := "sh -c '" + waitScript + "'"
+	if job.User != "root" {
+		command = "sudo -n " + command
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case <-ctx.Done():
+		client.Close()
+		return StageBusy, ctx.Err()
+	case err = <-done:
+		if err != nil {
+			return StageBusy, err
+		}
+	}
+
+	if job.HostKey == "" {
+		job.HostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(seen)))
+	}
+
+	return "", nil
+}
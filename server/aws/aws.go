@@ -92,7 +92,14 @@ func (s *AWS) CreateSSHKey(token string, sshKey string) (interface{}, error) {
 	return eo.KeyName, nil
 }
 
-func (s *AWS) CreateServer(token string, sshKey interface{}) (*string, *string, error) {
+var sizes = []server.Size{
+	{Name: "t3.nano", Memory: 512},
+	{Name: "t3.micro", Memory: 1024},
+	{Name: "t3.small", Memory: 2048},
+	{Name: "t3.medium", Memory: 4096},
+}
+
+func (s *AWS) CreateServer(token string, sshKey interface{}, memory int) (*string, *string, error) {
 	// Why do you have to be so insufferably difficult
 	sess, err := getSession(token)
 	if err != nil {
@@ -211,7 +218,7 @@ func (s *AWS) CreateServer(token string, sshKey interface{}) (*string, *string,
 	// run dem instances
 	rx, err := ecx.RunInstances(&ec2.RunInstancesInput{
 		ImageId:      aws.String("ami-042e8287309f5df03"), // Ubuntu 20.04 AMI in us-east-1, see https://cloud-images.ubuntu.com/locator/ec2/
-		InstanceType: aws.String("t3.small"),
+		InstanceType: aws.String(server.SmallestSize(sizes, memory)),
 		MinCount:     aws.Int64(1),
 		MaxCount:     aws.Int64(1),
 		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
@@ -259,9 +266,6 @@ func (s *AWS) CreateServer(token string, sshKey interface{}) (*string, *string,
 		time.Sleep(2 * time.Second)
 	}
 
-	// give the EC2 machine a little more time to boot up
-	time.Sleep(5 * time.Second)
-
 	return ip, nil, nil
 
 	// absolutely what the fuck did I just do
@@ -105,11 +105,18 @@ type SSHKeyCreated struct {
 
 var regions = []string{"nyc1", "nyc3", "sfo3"}
 
-func (d *DigitalOcean) CreateServer(token string, sshKey interface{}) (*string, *string, error) {
+var sizes = []server.Size{
+	{Name: "s-1vcpu-512mb-10gb", Memory: 512},
+	{Name: "s-1vcpu-1gb", Memory: 1024},
+	{Name: "s-1vcpu-2gb", Memory: 2048},
+	{Name: "s-2vcpu-4gb", Memory: 4096},
+}
+
+func (d *DigitalOcean) CreateServer(token string, sshKey interface{}, memory int) (*string, *string, error) {
 	droplet := &DropletCreate{
 		Name:    server.RandomString(10) + ".fediverse.express",
 		Region:  regions[rand.Intn(len(regions))],
-		Size:    "s-1vcpu-2gb",
+		Size:    server.SmallestSize(sizes, memory),
 		Image:   "ubuntu-20-04-x64",
 		Backups: false,
 		IPv6:    true,
@@ -10,7 +10,9 @@ type Provider interface {
 	OAuth2() *oauth2.Config
 
 	CreateSSHKey(token string, sshKey string) (interface{}, error)
-	CreateServer(token string, sshKey interface{}) (*string, *string, error)
+	// CreateServer creates the smallest server with at least memory MB of
+	// memory, returning its addresses.
+	CreateServer(token string, sshKey interface{}, memory int) (*string, *string, error)
 
 	EnterCredentials() (string, map[string]string)
 	ValidateCredentials(ctx *fiber.Ctx, session *session.Session) error
@@ -17,3 +17,21 @@ func RandomString(xlen int) string {
 	}
 	return str
 }
+
+// Size is a server size a provider sells, with its memory in MB.
+type Size struct {
+	Name   string
+	Memory int
+}
+
+// SmallestSize picks the smallest of sizes, listed smallest first, with at
+// least memory MB of memory, or the largest if none have that much.
+func SmallestSize(sizes []Size, memory int) string {
+	for _, size := range sizes {
+		if size.Memory >= memory {
+			return size.Name
+		}
+	}
+
+	return sizes[len(sizes)-1].Name
+}
@@ -0,0 +1,222 @@
+package main
+
+import "github.com/CuteAP/fediverse.express/runner"
+
+// Software is a fediverse server we know how to install. Adding one takes an
+// entry in software, and playbooks for it in catgirl.
+type Software struct {
+	Name        string
+	Description string
+
+	// Playbook installs it, relative to the playbook directory. Roles lists
+	// the playbook's roles in the order they run; each one is tagged with its
+	// own name so a failed install can pick up where it left off.
+	Playbook string
+	Roles    []string
+
+	// UpgradePlaybook moves it to another version, going through
+	// UpgradeRoles. Software without one can't be upgraded from here.
+	UpgradePlaybook string
+	UpgradeRoles    []string
+
+	// MinimumRAM is how much memory, in MB, a server needs to run it.
+	MinimumRAM int
+
+	// Versions lists the versions on offer, newest first, for software that
+	// lets you pick one. The one picked is passed to the playbooks as VersionVar.
+	Versions   func() []string
+	VersionVar string
+
+	// Vars are the variables the playbooks can't do without.
+	Vars []string
+	// DeploymentVars passes settings kept with the deployment on to the
+	// playbooks, on top of the ones every deployment has.
+	DeploymentVars func(deployment *Deployment) map[string]interface{}
+
+	// Customizable software can have its name, description and so on set up
+	// from the install form; see Customization. They are passed on as
+	// instance_settings, which not every runner acts on; see customizable.
+	Customizable bool
+
+	// Outputs are the secrets the playbook leaves for the user in its secrets
+	// directory, by file name, with what they are called on the done page.
+	Outputs map[string]string
+}
+
+// software is everything on offer, by the name it is picked with.
+var software = map[string]*Software{
+	"misskey": {
+		Name:            "Misskey",
+		Description:     "A feature-packed server with reactions, drive storage and a customizable interface.",
+		Playbook:        "main.yml",
+		Roles:           []string{"deps", "sys", "postgres", "install", "nginx", "post-install"},
+		UpgradePlaybook: "upgrade.yml",
+		UpgradeRoles:    []string{"upgrade"},
+		MinimumRAM:      2048,
+		Versions:        misskeyVersions,
+		VersionVar:      "misskey_version",
+		Vars:            []string{"domain", "email", "misskey_id"},
+		DeploymentVars:  misskeyVars,
+		Customizable:    true,
+		Outputs: map[string]string{
+			"postgresql":     "Your instance's database password (user misskey)",
+			"admin_password": "Your instance's admin password (user admin)",
+		},
+	},
+	"mastodon": {
+		Name:        "Mastodon",
+		Description: "The most widely used fediverse server, with apps for every platform.",
+		Playbook:    "mastodon/main.yml",
+		Roles:       []string{"deps", "sys", "postgres", "install", "nginx", "post-install"},
+		MinimumRAM:  2048,
+		Vars:        []string{"domain", "email"},
+		Outputs: map[string]string{
+			"postgresql":     "Your instance's database password (user mastodon)",
+			"admin_password": "Your instance's admin password (user admin)",
+		},
+	},
+	"pleroma": {
+		Name:        "Pleroma",
+		Description: "A lightweight server that runs comfortably on the smallest servers; a good fit for single-user instances.",
+		Playbook:    "pleroma/main.yml",
+		Roles:       []string{"deps", "sys", "postgres", "install", "nginx", "post-install"},
+		MinimumRAM:  1024,
+		Vars:        []string{"domain", "email"},
+		Outputs: map[string]string{
+			"postgresql":     "Your instance's database password (user pleroma)",
+			"admin_password": "Your instance's admin password (user admin)",
+		},
+	},
+	"gotosocial": {
+		Name:        "GoToSocial",
+		Description: "A small, young server that installs in about a minute. Some features are still missing.",
+		Playbook:    "gotosocial/main.yml",
+		Roles:       []string{"deps", "sys", "install", "nginx", "post-install"},
+		MinimumRAM:  512,
+		Vars:        []string{"domain", "email"},
+		Outputs: map[string]string{
+			"admin_password": "Your instance's admin password (user admin)",
+		},
+	},
+}
+
+// misskeyVars fills in Misskey's configuration from the deployment. Servers
+// installed before the ID scheme was recorded got Misskey's default, aid.
+func misskeyVars(deployment *Deployment) map[string]interface{} {
+	if deployment.IDGeneration == "" {
+		deployment.IDGeneration = "aid"
+	}
+
+	vars := map[string]interface{}{
+		"misskey_id":                 deployment.IDGeneration,
+		"misskey_proxy_remote_files": !deployment.DirectRemoteFiles,
+	}
+	if deployment.Proxy != "" {
+		vars["misskey_proxy"] = deployment.Proxy
+	}
+	if deployment.Customization != nil {
+		vars["instance_settings"] = deployment.Customization.Vars()
+	}
+
+	return vars
+}
+
+// showOnce are the outputs that are only shown the one time, right after they
+// were generated, and not kept after.
+var showOnce = map[string]bool{
+	"admin_password": true,
+}
+
+// softwareOrder is the order software is offered in.
+var softwareOrder = []string{"misskey", "mastodon", "pleroma", "gotosocial"}
+
+// customizable tells whether s can be customized with the runner in use.
+func customizable(s *Software) bool {
+	return s.Customizable && understands("instance_settings")
+}
+
+// offeredSoftware lists the software the runner in use can install, in the
+// order it is offered in.
+func offeredSoftware() []string {
+	offered := []string{}
+	for _, name := range softwareOrder {
+		if runs(software[name].Playbook) {
+			offered = append(offered, name)
+		}
+	}
+
+	return offered
+}
+
+// runs tells whether the runner in use can run a playbook.
+func runs(playbook string) bool {
+	limited, ok := installer.(runner.Limited)
+	return !ok || limited.Supports(playbook)
+}
+
+// understands tells whether the runner in use acts on a variable.
+func understands(variable string) bool {
+	limited, ok := installer.(runner.Limited)
+	return !ok || limited.Understands(variable)
+}
+
+// softwareOf returns the software a deployment runs. Deployments from before
+// there was a choice all run Misskey.
+func softwareOf(deployment *Deployment) *Software {
+	if deployment != nil {
+		if s, ok := software[deployment.Software]; ok {
+			return s
+		}
+	}
+
+	return software["misskey"]
+}
+
+// RolesFrom returns the roles to run when resuming an install at the given
+// role, or all of them if from isn't one.
+func (s *Software) RolesFrom(from string) []string {
+	run := []string{}
+	found := false
+
+	for _, role := range s.Roles {
+		if role == from {
+			found = true
+		}
+
+		if found {
+			run = append(run, role)
+		}
+	}
+
+	if !found {
+		return append([]string{}, s.Roles...)
+	}
+
+	return run
+}
+
+// IsRole tells whether name is one of the install playbook's roles.
+func (s *Software) IsRole(name string) bool {
+	for _, role := range s.Roles {
+		if role == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KnownVersion tells whether a version is one we offer.
+func (s *Software) KnownVersion(version string) bool {
+	if s.Versions == nil {
+		return false
+	}
+
+	for _, v := range s.Versions() {
+		if v == version {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRolesFrom(t *testing.T) {
+	sw := &Software{Roles: []string{"deps", "sys", "postgres", "install", "nginx", "post-install"}}
+
+	tests := []struct {
+		from string
+		want []string
+	}{
+		{"deps", sw.Roles},
+		{"install", []string{"install", "nginx", "post-install"}},
+		{"post-install", []string{"post-install"}},
+		{"", sw.Roles},
+		{"nonsense", sw.Roles},
+	}
+
+	for _, test := range tests {
+		if got := sw.RolesFrom(test.from); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("RolesFrom(%q) = %v, want %v", test.from, got, test.want)
+		}
+	}
+
+	// callers may change what they get back
+	sw.RolesFrom("deps")[0] = "changed"
+	if sw.Roles[0] != "deps" {
+		t.Errorf("RolesFrom handed out the software's own roles")
+	}
+}
@@ -11,6 +11,12 @@ var Footer string
 //go:embed index.html
 var Index string
 
+//go:embed software.html
+var Software string
+
+//go:embed softwareoption.html
+var SoftwareOption string
+
 //go:embed provision.html
 var Provision string
 
@@ -20,12 +26,63 @@ var Verify string
 //go:embed install.html
 var Install string
 
+//go:embed installemail.html
+var InstallEmail string
+
+//go:embed installversion.html
+var InstallVersion string
+
+//go:embed installstaging.html
+var InstallStaging string
+
+//go:embed installcustomize.html
+var InstallCustomize string
+
+//go:embed installownkey.html
+var InstallOwnKey string
+
+//go:embed installresume.html
+var InstallResume string
+
+//go:embed installlog.html
+var InstallLog string
+
 //go:embed running.html
 var Running string
 
+//go:embed runningcancel.html
+var RunningCancel string
+
 //go:embed done.html
 var Done string
 
+//go:embed doneadmin.html
+var DoneAdmin string
+
+//go:embed doneadmintaken.html
+var DoneAdminTaken string
+
+//go:embed donekey.html
+var DoneKey string
+
+//go:embed doneownkey.html
+var DoneOwnKey string
+
+//go:embed doneupgrade.html
+var DoneUpgrade string
+
+//go:embed donestaging.html
+var DoneStaging string
+
+//go:embed donecredential.html
+var DoneCredential string
+
+//go:embed donecredentialonce.html
+var DoneCredentialOnce string
+
+//go:embed donecredentialshown.html
+var DoneCredentialShown string
+
 //go:embed prov.html
 var Prov string
 
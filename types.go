@@ -1,10 +1,102 @@
 package main
 
+import (
+	"context"
+	"sync"
+)
+
+type ProvisionInput struct {
+	PublicKey string
+}
+
 type InstallStartInput struct {
 	Hostname string
 }
 
+// Status follows a job from when it's queued until it's done. The job writes
+// to it from its own goroutine while handlers read it, so how the job ended is
+// only reached through its methods.
 type Status struct {
-	Error error
-	Done  bool
+	sync.Mutex
+
+	// Kind is the kind of job being followed, as in JobRecord.
+	Kind     string
+	Progress *Progress
+
+	err         error
+	done        bool
+	cancelled   bool
+	interrupted bool
+
+	cancel context.CancelFunc
+}
+
+// Done tells whether the job finished successfully.
+func (sx *Status) Done() bool {
+	sx.Lock()
+	defer sx.Unlock()
+
+	return sx.done
+}
+
+// Err returns why the job failed, if it did.
+func (sx *Status) Err() error {
+	sx.Lock()
+	defer sx.Unlock()
+
+	return sx.err
+}
+
+// Finished tells whether the job is over, one way or the other.
+func (sx *Status) Finished() bool {
+	sx.Lock()
+	defer sx.Unlock()
+
+	return sx.done || sx.err != nil
+}
+
+// Cancelled tells whether the user cancelled the job.
+func (sx *Status) Cancelled() bool {
+	sx.Lock()
+	defer sx.Unlock()
+
+	return sx.cancelled
+}
+
+// Interrupted tells whether the job was stopped by fediverse.express shutting down.
+func (sx *Status) Interrupted() bool {
+	sx.Lock()
+	defer sx.Unlock()
+
+	return sx.interrupted
+}
+
+// finish records how the job ended: successfully if err is nil.
+func (sx *Status) finish(err error) {
+	sx.Lock()
+	defer sx.Unlock()
+
+	sx.err = err
+	sx.done = err == nil
+}
+
+// cancelWith records that the user cancelled the job, failing it with err.
+func (sx *Status) cancelWith(err error) {
+	sx.Lock()
+	defer sx.Unlock()
+
+	sx.cancelled = true
+	sx.err = err
+}
+
+// interrupt stops a job because fediverse.express is shutting down, rather
+// than because the user asked for it.
+func (sx *Status) interrupt() {
+	sx.Lock()
+	sx.interrupted = true
+	sx.Unlock()
+
+	if sx.cancel != nil {
+		sx.cancel()
+	}
 }
@@ -1,17 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
 	"math/rand"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/CuteAP/fediverse.express/runner"
 	"github.com/CuteAP/fediverse.express/server"
+	"github.com/CuteAP/fediverse.express/templates"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/oauth2"
 )
 
 const vals = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+// private keys are a few kilobytes at most; anything bigger isn't one
+const maxPrivateKeySize = 16 * 1024
+
 func SeedRNG() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -36,6 +54,326 @@ func redirectWithState(prx server.Provider, ctx *fiber.Ctx) error {
 	return nil
 }
 
+// ownPublicKey returns the SSH public key the user brought along, if any.
+func ownPublicKey(session *session.Session) (ssh.PublicKey, bool) {
+	authorizedKey, ok := session.Get("publicKey").(string)
+	if !ok {
+		return nil, false
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, false
+	}
+
+	return publicKey, true
+}
+
+// privateKeyPEM encodes the private key generated for the session.
+func privateKeyPEM(session *session.Session) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    "RSA PRIVATE KEY",
+		Headers: nil,
+		Bytes:   x509.MarshalPKCS1PrivateKey(session.Get("privateKey").(*rsa.PrivateKey)),
+	})
+}
+
+// jobKey returns the private key to run a job with: the one the user uploads,
+// if they brought their own, or the one we generated for them.
+func jobKey(ctx *fiber.Ctx, session *session.Session) ([]byte, error) {
+	publicKey, ok := ownPublicKey(session)
+	if !ok {
+		return privateKeyPEM(session), nil
+	}
+
+	// the user's own private key only lives on disk for as long as the job runs
+	fh, err := ctx.FormFile("PrivateKey")
+	if err != nil {
+		return nil, errors.New("upload the private key belonging to the public key you provided to continue")
+	}
+
+	return readOwnPrivateKey(fh, publicKey)
+}
+
+// readOwnPrivateKey reads an uploaded private key and makes sure it belongs to
+// the public key the user registered with their provider.
+func readOwnPrivateKey(fh *multipart.FileHeader, publicKey ssh.PublicKey) ([]byte, error) {
+	if fh.Size > maxPrivateKeySize {
+		return nil, errors.New("that file is too large to be an SSH private key")
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, errors.New("could not read the uploaded private key")
+	}
+	defer f.Close()
+
+	key, err := io.ReadAll(io.LimitReader(f, maxPrivateKeySize))
+	if err != nil {
+		return nil, errors.New("could not read the uploaded private key")
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, errors.New("your private key is protected by a passphrase, which the installer can't enter. Upload a copy without a passphrase (ssh-keygen -p -N '' -f copy-of-your-key)")
+		}
+
+		return nil, errors.New("the uploaded file isn't an SSH private key we understand")
+	}
+
+	if !bytes.Equal(signer.PublicKey().Marshal(), publicKey.Marshal()) {
+		return nil, errors.New("the uploaded private key does not belong to the public key you provided")
+	}
+
+	return key, nil
+}
+
+// installForm renders the install step, asking for the user's own private key
+// if they provided a public key earlier on, and offering to resume a failed install.
+func installForm(session *session.Session) string {
+	fields := ""
+	email := ""
+	staging := letsEncryptStaging
+	version := ""
+	var customization *Customization
+
+	sw := software["misskey"]
+	if name, ok := session.Get("software").(string); ok && software[name] != nil {
+		sw = software[name]
+	}
+
+	if ipv4, ok := session.Get("ipv4").(*string); ok && ipv4 != nil {
+		if deployment, err := loadDeployment(*ipv4); err == nil {
+			email = deployment.Email
+			version = deployment.Version
+			customization = deployment.Customization
+			if len(deployment.Jobs) > 0 {
+				sw = softwareOf(deployment)
+				staging = deployment.Staging
+			}
+
+			// offer to skip what already worked the last time around
+			if deployment.ResumeRole() != "" {
+				fields += fmt.Sprintf(templates.InstallResume, deployment.ResumeRole(), deployment.ResumeRole())
+			}
+		}
+	}
+
+	fields += fmt.Sprintf(templates.InstallEmail, html.EscapeString(email))
+
+	if sw.Versions != nil {
+		fields += fmt.Sprintf(templates.InstallVersion, sw.Name, versionOptions(sw, version))
+	}
+
+	checked := ""
+	if staging {
+		checked = "checked"
+	}
+	fields += fmt.Sprintf(templates.InstallStaging, checked)
+
+	if customizable(sw) {
+		fields += customizationFields(customization)
+	}
+
+	return fmt.Sprintf(templates.Install, sw.Name, fields+ownKeyField(session))
+}
+
+// softwareForm renders the software step, with what the user picked before
+// picked again.
+func softwareForm(session *session.Session) string {
+	offered := offeredSoftware()
+
+	picked, ok := session.Get("software").(string)
+	if !ok && len(offered) > 0 {
+		picked = offered[0]
+	}
+
+	options := ""
+	for _, name := range offered {
+		checked := ""
+		if name == picked {
+			checked = " checked"
+		}
+
+		sw := software[name]
+		options += fmt.Sprintf(templates.SoftwareOption, name, checked, sw.Name, html.EscapeString(sw.Description), ramSize(sw.MinimumRAM))
+	}
+
+	return fmt.Sprintf(templates.Software, options)
+}
+
+// ramSize describes an amount of memory in MB the way providers sell it.
+func ramSize(mb int) string {
+	if mb >= 1024 && mb%1024 == 0 {
+		return fmt.Sprintf("%d GB", mb/1024)
+	}
+
+	return fmt.Sprintf("%d MB", mb)
+}
+
+// versionOptions lists the versions of a piece of software on offer, with the
+// given one picked, or the newest if it isn't among them.
+func versionOptions(sw *Software, version string) string {
+	list := sw.Versions()
+	if !sw.KnownVersion(version) && len(list) > 0 {
+		version = list[0]
+	}
+
+	options := ""
+	for _, v := range list {
+		selected := ""
+		if v == version {
+			selected = " selected"
+		}
+
+		options += fmt.Sprintf("<option value=\"%s\"%s>%s</option>", html.EscapeString(v), selected, html.EscapeString(v))
+	}
+
+	return options
+}
+
+// doneRows renders the done page's rows after the domain and address. once
+// holds the secrets that are only shown the one time; the bundle leaves out
+// the forms, which only work on the live page.
+func doneRows(session *session.Session, deployment *Deployment, once map[string]string, bundle bool) string {
+	rows := ""
+	if publicKey, ok := ownPublicKey(session); ok {
+		rows = fmt.Sprintf(templates.DoneOwnKey, ssh.FingerprintSHA256(publicKey))
+	} else {
+		pk := privateKeyPEM(session)
+		rows = fmt.Sprintf(templates.DoneKey, string(pk), string(pk))
+	}
+
+	if deployment == nil {
+		return rows
+	}
+
+	sw := softwareOf(deployment)
+
+	if !bundle {
+		if deployment.Certificate == "staging" {
+			rows += fmt.Sprintf(templates.DoneStaging, ownKeyField(session))
+		}
+
+		if deployment.Installed() && sw.UpgradePlaybook != "" && runs(sw.UpgradePlaybook) {
+			version := deployment.Version
+			if version == "" {
+				version = "unknown"
+			}
+			if len(deployment.Commit) >= 7 {
+				version += " (commit " + deployment.Commit[:7] + ")"
+			}
+
+			// offer the newest release, rather than what's already there
+			rows += fmt.Sprintf(templates.DoneUpgrade, sw.Name, html.EscapeString(version), sw.Name, versionOptions(sw, ""), ownKeyField(session), sw.Name)
+		}
+	}
+
+	// the secrets the install generated are only shown here
+	for _, name := range sortedKeys(sw.Outputs) {
+		label := html.EscapeString(sw.Outputs[name])
+
+		if showOnce[name] {
+			if once[name] != "" && bundle {
+				rows += fmt.Sprintf(templates.DoneCredential, label, html.EscapeString(once[name]))
+				continue
+			}
+			if once[name] != "" {
+				rows += fmt.Sprintf(templates.DoneCredentialOnce, label, html.EscapeString(once[name]))
+				continue
+			}
+
+			if deployment.Generated(name) {
+				rows += fmt.Sprintf(templates.DoneCredentialShown, label)
+			}
+			continue
+		}
+
+		if value := deployment.Secret(name); value != "" {
+			rows += fmt.Sprintf(templates.DoneCredential, label, html.EscapeString(value))
+		}
+	}
+
+	return rows
+}
+
+// doneSteps renders the done page's steps that depend on how the install
+// went: the admin account is only there if one was made, and the user is
+// warned if somebody else signed up first instead.
+func doneSteps(deployment *Deployment) string {
+	if deployment != nil && deployment.Generated("admin_password") {
+		return templates.DoneAdmin
+	}
+	if deployment != nil && deployment.Generated("admin_taken") {
+		return templates.DoneAdminTaken
+	}
+
+	return ""
+}
+
+// ownKeyField asks for the user's own private key, if they brought one.
+func ownKeyField(session *session.Session) string {
+	if publicKey, ok := ownPublicKey(session); ok {
+		return fmt.Sprintf(templates.InstallOwnKey, ssh.FingerprintSHA256(publicKey))
+	}
+
+	return ""
+}
+
+// installLog renders the transcript of the last job run against a server, for
+// when it didn't go well.
+func installLog(ipv4 string) string {
+	deployment, err := loadDeployment(ipv4)
+	if err != nil || deployment.LastJob() == nil {
+		return ""
+	}
+
+	transcript, err := os.ReadFile(deployment.LogPath(deployment.LastJob()))
+	if err != nil || len(transcript) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(templates.InstallLog, html.EscapeString(string(transcript)))
+}
+
+// validateEmail checks that an address is fit to hand to Let's Encrypt: a
+// bare address, without a display name, at a real-looking domain. Ansible
+// would evaluate anything that looks like a template in it, so that's out too.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return errors.New("enter a valid e-mail address, such as you@example.com")
+	}
+
+	for _, marker := range []string{"{{", "{%", "{#"} {
+		if strings.Contains(email, marker) {
+			return errors.New("enter a valid e-mail address, such as you@example.com")
+		}
+	}
+
+	at := strings.LastIndex(email, "@")
+	if !strings.Contains(email[at+1:], ".") {
+		return errors.New("enter an e-mail address at a real domain, such as you@example.com")
+	}
+
+	return nil
+}
+
+// notReadyMessage explains to the user why their server couldn't be set up yet.
+func notReadyMessage(err *runner.NotReadyError, timeout time.Duration) error {
+	switch {
+	case errors.Is(err, runner.ErrHostKeyMismatch):
+		return errors.New("Your server's SSH host key is different from the one it had when we first connected to it. If you rebuilt or replaced the server, provision a new one; otherwise someone may be intercepting the connection. Please e-mail us so we can help you out.")
+	case err.Stage == runner.StagePort:
+		return fmt.Errorf("Your server didn't start accepting SSH connections within %s. Check that it is on and that your provider's firewall allows SSH (port 22), then try again.", timeout)
+	case err.Stage == runner.StageLogin:
+		return fmt.Errorf("Your server didn't let us log in with your SSH key within %s. Check that it was created with the right key, then try again.", timeout)
+	default:
+		return fmt.Errorf("Your server was still busy setting itself up (installing updates) after %s. Give it a few minutes and try again.", timeout)
+	}
+}
+
 type Keys struct {
 	PublicKey  []byte
 	PrivateKey []byte
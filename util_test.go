@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/CuteAP/fediverse.express/templates"
+)
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		ok    bool
+	}{
+		{"admin@example.com", true},
+		{"first.last+tag@mail.example.co.uk", true},
+		{"Admin <admin@example.com>", false},
+		{"admin@localhost", false},
+		{"not an address", false},
+		{"{{q}}@example.com", false},
+		{"{%q%}@example.com", false},
+		{"{#q#}@example.com", false},
+		{"{q}@example.com", true},
+	}
+
+	for _, test := range tests {
+		if err := validateEmail(test.email); (err == nil) != test.ok {
+			t.Errorf("validateEmail(%q) = %v, want ok %t", test.email, err, test.ok)
+		}
+	}
+}
+
+func TestDoneSteps(t *testing.T) {
+	made := &Deployment{Jobs: []*JobRecord{{Credentials: map[string]string{"admin_password": ""}}}}
+	taken := &Deployment{Jobs: []*JobRecord{{Credentials: map[string]string{"admin_taken": "yes"}}}}
+
+	if doneSteps(made) != templates.DoneAdmin {
+		t.Error("done page doesn't point to the admin account that was made")
+	}
+	if !strings.Contains(doneSteps(taken), "signed up") {
+		t.Error("done page doesn't warn that somebody else signed up first")
+	}
+	if doneSteps(&Deployment{}) != "" || doneSteps(nil) != "" {
+		t.Error("done page mentions an admin account when none was tried")
+	}
+}
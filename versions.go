@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// misskeyRepo is where Misskey gets installed from.
+const misskeyRepo = "https://github.com/syuilo/misskey.git"
+
+// how many releases are offered, and how long the list is trusted for
+const (
+	versionCount = 10
+	versionTTL   = time.Hour
+)
+
+var (
+	// the playbooks build Misskey with yarn; 13 moved to pnpm and a newer
+	// Node, so only 12's releases are offered
+	releaseTag = regexp.MustCompile(`^12\.[0-9]+\.[0-9]+$`)
+
+	versions struct {
+		sync.Mutex
+		list    []string
+		fetched time.Time
+		// refreshing is set while a fetch is under way, so only one runs at a time
+		refreshing bool
+	}
+)
+
+// misskeyVersions returns the most recent Misskey releases, newest first. The
+// list comes from the git remote, or from the copy kept from the last time
+// that worked if it can't be reached. A stale list is refreshed in the
+// background and served as it is in the meantime; only if there is no list at
+// all is the fetch waited for. If that fails too, there are none on offer.
+func misskeyVersions() []string {
+	versions.Lock()
+
+	if versions.list == nil {
+		versions.list = readCachedVersions()
+	}
+
+	list := versions.list
+	refresh := time.Since(versions.fetched) >= versionTTL && !versions.refreshing
+	if refresh {
+		versions.refreshing = true
+	}
+
+	versions.Unlock()
+
+	switch {
+	case refresh && list == nil:
+		refreshVersions()
+
+		versions.Lock()
+		defer versions.Unlock()
+
+		return versions.list
+	case refresh:
+		go refreshVersions()
+	case list == nil:
+		// somebody else is fetching the very first list
+		return nil
+	}
+
+	return list
+}
+
+// versionsCache is where the last list fetched is kept.
+func versionsCache() string {
+	return filepath.Join(dataDir, "misskey-versions.json")
+}
+
+func readCachedVersions() []string {
+	var list []string
+
+	data, err := os.ReadFile(versionsCache())
+	if err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading cached Misskey versions: %v", err)
+	}
+
+	// it may be from before some releases stopped being offered
+	offered := []string{}
+	for _, tag := range list {
+		if releaseTag.MatchString(tag) {
+			offered = append(offered, tag)
+		}
+	}
+	if len(offered) == 0 {
+		return nil
+	}
+
+	return offered
+}
+
+// refreshVersions fetches the list of versions without holding on to the lock
+// while it waits for the remote.
+func refreshVersions() {
+	list, err := fetchVersions()
+	if err == nil {
+		data, _ := json.Marshal(list)
+
+		err := os.MkdirAll(dataDir, 0700)
+		if err == nil {
+			err = os.WriteFile(versionsCache(), data, 0600)
+		}
+		if err != nil {
+			log.Printf("Error caching Misskey versions: %v", err)
+		}
+	}
+
+	versions.Lock()
+	defer versions.Unlock()
+
+	versions.refreshing = false
+
+	if err != nil {
+		log.Printf("Error fetching Misskey versions, keeping the list there is: %v", err)
+
+		// try again in a minute
+		versions.fetched = time.Now().Add(time.Minute - versionTTL)
+		return
+	}
+
+	versions.list = list
+	versions.fetched = time.Now()
+}
+
+func fetchVersions() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "git", "ls-remote", "--tags", "--refs", misskeyRepo).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := releases(string(out))
+	if len(tags) == 0 {
+		return nil, errors.New("no release tags found")
+	}
+
+	return tags, nil
+}
+
+// releases picks the newest releases on offer out of git ls-remote's list of
+// tags, newest first.
+func releases(lsRemote string) []string {
+	var tags []string
+	for _, line := range strings.Split(lsRemote, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		tag := strings.TrimPrefix(fields[1], "refs/tags/")
+		if releaseTag.MatchString(tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return newerVersion(tags[i], tags[j])
+	})
+
+	if len(tags) > versionCount {
+		tags = tags[:versionCount]
+	}
+
+	return tags
+}
+
+// newerVersion compares two release tags part by part.
+func newerVersion(a string, b string) bool {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+
+		if x != y {
+			return x > y
+		}
+	}
+
+	return len(as) > len(bs)
+}
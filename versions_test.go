@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewerVersion(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"12.119.0", "12.118.1", true},
+		{"12.118.1", "12.119.0", false},
+		{"12.10.0", "12.9.0", true},
+		{"13.0.0", "12.119.2", true},
+		{"12.119.0", "12.119.0", false},
+		{"12.119.0.1", "12.119.0", true},
+		{"12.119", "12.119.0", false},
+	}
+
+	for _, test := range tests {
+		if got := newerVersion(test.a, test.b); got != test.want {
+			t.Errorf("newerVersion(%q, %q) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestReleases(t *testing.T) {
+	lsRemote := `abc	refs/tags/12.118.1
+def	refs/tags/12.119.2
+012	refs/tags/13.0.0
+345	refs/tags/2023.9.0
+678	refs/tags/12.119.0-beta.1
+9ab	refs/tags/12.9.0
+`
+
+	if got, want := releases(lsRemote), []string{"12.119.2", "12.118.1", "12.9.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("releases = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/CuteAP/fediverse.express/catgirl"
+	"github.com/CuteAP/fediverse.express/runner"
+)
+
+// newWorkDir sets up a private directory for a single job, holding its copy
+// of the SSH key, the playbook unless an on-disk one is used, and the secrets
+// the run generates. Secrets from earlier jobs are put back first, so the run
+// reuses them instead of making up new ones. Nothing in it outlives the job.
+func newWorkDir(key []byte, secrets map[string]string) (string, error) {
+	dir, err := os.MkdirTemp("", "catgirl-job-")
+	if err != nil {
+		return "", err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "id"), key, 0600)
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dir, "secrets"), 0700)
+	}
+	for name, secret := range secrets {
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, "secrets", name), []byte(secret), 0600)
+		}
+	}
+	if err == nil && playbookDir == "" {
+		err = catgirl.Materialize(filepath.Join(dir, "playbook"))
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// sortedKeys lists the names of a set of secrets in a stable order.
+func sortedKeys(secrets map[string]string) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// readSecrets collects the secrets a run left behind, by file name.
+func readSecrets(dir string) (map[string]string, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := map[string]string{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		secrets[file.Name()] = runner.ParseSecret(data)
+	}
+
+	return secrets, nil
+}